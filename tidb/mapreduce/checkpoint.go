@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+)
+
+// checkpoint records the completed tasks of a job in a manifest, so that a
+// job resubmitted with the same name and inputs skips the tasks whose
+// outputs are still intact.
+type checkpoint struct {
+	fileName string
+
+	mu       sync.Mutex
+	manifest jobManifest
+}
+
+// jobManifest is the content of the manifest of a job.
+type jobManifest struct {
+	Job         string                   `json:"job"`
+	Fingerprint jobFingerprint           `json:"fingerprint"`
+	Tasks       map[string]*manifestTask `json:"tasks"` // keyed by taskKey
+}
+
+// jobFingerprint identifies the inputs and the settings of a job which
+// affect its outputs, the manifest of a different job is discarded.
+type jobFingerprint struct {
+	Inputs      []inputFingerprint `json:"inputs"`
+	Splits      int                `json:"splits"`
+	SplitSize   int64              `json:"split_size"`
+	NReduce     int                `json:"n_reduce"`
+	MapF        string             `json:"map_f"`
+	ReduceF     string             `json:"reduce_f"`
+	CombineF    string             `json:"combine_f"`
+	Partitioner string             `json:"partitioner"`
+	Format      IntermediateFormat `json:"format"`
+	Compression Compression        `json:"compression"`
+	TempDir     string             `json:"temp_dir"`
+}
+
+type inputFingerprint struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"` // in unix nanoseconds
+}
+
+// manifestTask records a completed task.
+type manifestTask struct {
+	Outputs []manifestFile `json:"outputs"`
+	Metrics TaskMetrics    `json:"metrics"`
+}
+
+// manifestFile records an output file of a completed task.
+type manifestFile struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+func newJobFingerprint(cfg *jobConfig, mapFiles []string, nSplits, nReduce int) (jobFingerprint, error) {
+	fp := jobFingerprint{
+		Splits:      nSplits,
+		SplitSize:   cfg.splitSize,
+		NReduce:     nReduce,
+		MapF:        cfg.mapFName,
+		ReduceF:     cfg.reduceFName,
+		CombineF:    funcName(cfg.combineF),
+		Partitioner: fmt.Sprintf("%#v", cfg.partitioner),
+		Format:      cfg.format,
+		Compression: cfg.compression,
+		TempDir:     cfg.tempDir,
+	}
+	for _, name := range mapFiles {
+		stat, err := os.Stat(name)
+		if err != nil {
+			return fp, err
+		}
+		fp.Inputs = append(fp.Inputs, inputFingerprint{Name: name, Size: stat.Size(), ModTime: stat.ModTime().UnixNano()})
+	}
+	return fp, nil
+}
+
+// openCheckpoint loads the manifest of a job, a new manifest is written if
+// there is none or the existing one is written by a different job.
+func openCheckpoint(fileName, jobName string, fp jobFingerprint) (*checkpoint, error) {
+	cp := &checkpoint{fileName: fileName}
+	if data, err := ioutil.ReadFile(fileName); err == nil {
+		if json.Unmarshal(data, &cp.manifest) == nil && cp.manifest.Job == jobName && reflect.DeepEqual(cp.manifest.Fingerprint, fp) {
+			return cp, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	cp.manifest = jobManifest{Job: jobName, Fingerprint: fp, Tasks: make(map[string]*manifestTask)}
+	if err := cp.save(); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func taskKey(phase jobPhase, taskNumber int) string {
+	return fmt.Sprintf("%s-%d", phase, taskNumber)
+}
+
+// outputNames returns the output files of a task.
+func (t *task) outputNames() []string {
+	if t.phase == reducePhase {
+		return []string{stagedName(t.dataDir, t.jobName, t.taskNumber)}
+	}
+	names := make([]string, t.nReduce)
+	for r := range names {
+		names[r] = reduceName(t.cfg.tempDir, t.jobName, t.taskNumber, r)
+	}
+	return names
+}
+
+// completed tells whether a task is recorded as completed and its outputs
+// are intact, the metrics of the task are restored if so.
+func (cp *checkpoint) completed(t *task) bool {
+	cp.mu.Lock()
+	mt, ok := cp.manifest.Tasks[taskKey(t.phase, t.taskNumber)]
+	cp.mu.Unlock()
+	if !ok {
+		return false
+	}
+	names := t.outputNames()
+	if len(mt.Outputs) != len(names) {
+		return false
+	}
+	published := false
+	for i, name := range names {
+		// 作业提交后，reduce任务的输出已被发布到最终的文件名
+		if t.phase == reducePhase && mt.Outputs[i].Name == mergeName(t.dataDir, t.jobName, t.taskNumber) {
+			name, published = mt.Outputs[i].Name, true
+		}
+		f, err := checksumFile(name)
+		if err != nil || f != mt.Outputs[i] {
+			return false
+		}
+	}
+	t.metrics = mt.Metrics
+	t.metrics.Resumed = true
+	t.published = published
+	return true
+}
+
+// record records a completed task and saves the manifest.
+func (cp *checkpoint) record(t *task) error {
+	mt := &manifestTask{Metrics: t.metrics}
+	for _, name := range t.outputNames() {
+		f, err := checksumFile(name)
+		if err != nil {
+			return err
+		}
+		mt.Outputs = append(mt.Outputs, f)
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.manifest.Tasks[taskKey(t.phase, t.taskNumber)] = mt
+	return cp.save()
+}
+
+// publish records that the outputs of the reduce tasks are published as files.
+func (cp *checkpoint) publish(files []manifestFile) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for r, f := range files {
+		if mt, ok := cp.manifest.Tasks[taskKey(reducePhase, r)]; ok {
+			mt.Outputs = []manifestFile{f}
+		}
+	}
+	return cp.save()
+}
+
+func (cp *checkpoint) save() error {
+	data, err := json.MarshalIndent(&cp.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(cp.fileName, data)
+}
+
+// checksumFile returns the size and the CRC-32 checksum of a file.
+func checksumFile(name string) (manifestFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	return manifestFile{Name: name, Size: size, CRC32: h.Sum32()}, nil
+}
+
+// manifestName returns the name of the manifest of a job.
+func manifestName(dataDir, jobName string) string {
+	return path.Join(dataDir, "mrtmp."+jobName+"-manifest.json")
+}
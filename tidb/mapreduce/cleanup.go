@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy tells when the intermediate files of a job are deleted.
+type RetentionPolicy int
+
+const (
+	// DeleteIntermediate deletes the intermediate files of a job once it
+	// finishes, it is the default. A checkpointed job keeps its manifest and
+	// the outputs of its completed tasks whether it succeeds or not, for it
+	// to resume from them when it is submitted again.
+	DeleteIntermediate RetentionPolicy = iota
+	// KeepIntermediateOnFailure deletes the intermediate files of a job only
+	// if it succeeds, the files of a failed job are kept for debugging.
+	KeepIntermediateOnFailure
+	// KeepIntermediate never deletes the intermediate files of a job.
+	KeepIntermediate
+)
+
+// intermediatePattern matches the intermediate files of a job and the
+// temporary files left by its attempts, the first submatch is the job name.
+var intermediatePattern = regexp.MustCompile(`^mrtmp\.(.+)-(\d+-\d+(\.attempt-\d+(\.(spill|merge)-\d+)?)?|_temporary|(metrics\.json|manifest\.json|_SUCCESS)\.tmp)$`)
+
+// retains tells whether the intermediate files of a job finished with err
+// are kept, the files of a checkpointed job are always kept.
+func (cfg *jobConfig) retains(err error) bool {
+	switch cfg.retention {
+	case KeepIntermediate:
+		return true
+	case KeepIntermediateOnFailure:
+		if err != nil {
+			return true
+		}
+	}
+	return cfg.checkpointing
+}
+
+// removeIntermediate removes the intermediate files of a finished job, the
+// outputs, the metrics report and the _SUCCESS manifest are kept.
+func (j *Job) removeIntermediate() {
+	if j.cfg != nil {
+		removeIntermediateFiles(j.cfg, j.dataDir, j.name, j.nMap, j.nReduce)
+	}
+}
+
+// Cleanup removes the intermediate files of the job named jobName submitted
+// to this cluster, including the ones it keeps by its retention policy and
+// its checkpoint. The files are found in the data dir of the latest submitted
+// job of the name and the temp dir of this cluster, so the files left by the
+// earlier runs of the job are removed as well. The outputs of the job are
+// kept. It returns an error if the job is unknown or running.
+func (c *MRCluster) Cleanup(jobName string) error {
+	c.mu.Lock()
+	dataDir, ok := c.dataDirs[jobName]
+	running := c.running[jobName] > 0
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("mapreduce: unknown job %s", jobName)
+	}
+	if running {
+		return fmt.Errorf("mapreduce: job %s is running", jobName)
+	}
+	dirs := []string{dataDir}
+	if c.opts.TempDir != "" && c.opts.TempDir != dataDir {
+		dirs = append(dirs, c.opts.TempDir)
+	}
+	for _, dir := range dirs {
+		_, err := sweepDir(dir, func(job string, info os.FileInfo) bool { return job == jobName })
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(manifestName(dataDir, jobName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SweepOrphans removes the intermediate files in dir which are left by
+// crashed jobs, it returns the names of the removed files. A file is an
+// orphan if it has not been modified for olderThan and its job is not
+// running in this cluster, olderThan should be long enough for the jobs
+// running in other clusters sharing dir not to be swept. The intermediate
+// files a checkpointed job would resume from are swept as well.
+func (c *MRCluster) SweepOrphans(dir string, olderThan time.Duration) ([]string, error) {
+	c.mu.Lock()
+	running := make(map[string]bool, len(c.running))
+	for name := range c.running {
+		running[name] = true
+	}
+	c.mu.Unlock()
+	return sweepDir(dir, func(job string, info os.FileInfo) bool {
+		return !running[job] && time.Since(info.ModTime()) >= olderThan
+	})
+}
+
+// sweepDir removes the intermediate files in dir selected by match, which is
+// called with the name of the job of each file. It returns the names of the
+// removed files.
+func sweepDir(dir string, match func(jobName string, info os.FileInfo) bool) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, info := range infos {
+		m := intermediatePattern.FindStringSubmatch(info.Name())
+		if m == nil || !match(m[1], info) {
+			continue
+		}
+		name := path.Join(dir, info.Name())
+		if err := os.RemoveAll(name); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+// removeIntermediateFiles removes the intermediate files of a job, including
+// the ones left by its attempts.
+func removeIntermediateFiles(cfg *jobConfig, dataDir, jobName string, nMap, nReduce int) {
+	names := intermediateNames(cfg, jobName, nMap, nReduce)
+	for _, name := range names {
+		os.Remove(name)
+	}
+	removeAttemptFiles(names...)
+	os.RemoveAll(stagingDir(dataDir, jobName))
+	os.Remove(manifestName(dataDir, jobName))
+}
+
+// removeAttemptLeftovers removes the files left by the unfinished attempts
+// of a job, the committed outputs of its tasks are kept.
+func removeAttemptLeftovers(cfg *jobConfig, dataDir, jobName string, nMap, nReduce int) {
+	names := intermediateNames(cfg, jobName, nMap, nReduce)
+	for r := 0; r < nReduce; r++ {
+		names = append(names, stagedName(dataDir, jobName, r))
+	}
+	removeAttemptFiles(names...)
+}
+
+// intermediateNames returns the names of the intermediate files of a job.
+func intermediateNames(cfg *jobConfig, jobName string, nMap, nReduce int) []string {
+	names := make([]string, 0, nMap*nReduce)
+	for r := 0; r < nReduce; r++ {
+		for m := 0; m < nMap; m++ {
+			names = append(names, reduceName(cfg.tempDir, jobName, m, r))
+		}
+	}
+	return names
+}
+
+// removeAttemptFiles removes the files written by the attempts of names,
+// including the runs spilled by them. Each directory is listed only once.
+func removeAttemptFiles(names ...string) {
+	dirs := make(map[string]map[string]bool) // the base names of the files in each directory
+	for _, name := range names {
+		dir := path.Dir(name)
+		if dirs[dir] == nil {
+			dirs[dir] = make(map[string]bool)
+		}
+		dirs[dir][path.Base(name)] = true
+	}
+	for dir, bases := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			if i := strings.LastIndex(info.Name(), ".attempt-"); i >= 0 && bases[info.Name()[:i]] {
+				os.Remove(path.Join(dir, info.Name()))
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+// The reduce tasks of a job write their outputs into a temporary directory
+// of the job, the outputs are published to the data dir only after all of
+// the reduce tasks succeed, followed by a _SUCCESS manifest. A reader should
+// wait for the manifest before reading the outputs of a job, the outputs
+// without a manifest are left by a running or failed job.
+
+// SuccessManifest lists the outputs published by a succeeded job.
+type SuccessManifest struct {
+	Job     string         `json:"job"`
+	Outputs []manifestFile `json:"outputs"` // in the order of the reduce tasks
+}
+
+// ReadSuccessManifest reads the _SUCCESS manifest of a job in dataDir, it
+// returns an error satisfying os.IsNotExist if the job has not succeeded.
+func ReadSuccessManifest(dataDir, jobName string) (*SuccessManifest, error) {
+	data, err := ioutil.ReadFile(successName(dataDir, jobName))
+	if err != nil {
+		return nil, err
+	}
+	m := new(SuccessManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// commitJob publishes the staged outputs of the reduce tasks of a job and
+// writes its _SUCCESS manifest, which is returned. The output of a reduce
+// task resumed from its published output is left where it is.
+func commitJob(dataDir, jobName string, tasks []*task) (*SuccessManifest, error) {
+	// 先删除上一次提交的标记，避免读者把新旧文件混在一起
+	if err := os.Remove(successName(dataDir, jobName)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	m := &SuccessManifest{Job: jobName}
+	for _, t := range tasks {
+		name := mergeName(dataDir, jobName, t.taskNumber)
+		if t.published {
+			f, err := checksumFile(name)
+			if err != nil {
+				return nil, err
+			}
+			m.Outputs = append(m.Outputs, f)
+			continue
+		}
+		f, err := checksumFile(stagedName(dataDir, jobName, t.taskNumber))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Rename(f.Name, name); err != nil {
+			return nil, err
+		}
+		f.Name = name
+		m.Outputs = append(m.Outputs, f)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomically(successName(dataDir, jobName), data); err != nil {
+		return nil, err
+	}
+	os.RemoveAll(stagingDir(dataDir, jobName))
+	return m, nil
+}
+
+// stagingDir returns the temporary directory of the outputs of a job.
+func stagingDir(dataDir, jobName string) string {
+	return path.Join(dataDir, "mrtmp."+jobName+"-_temporary")
+}
+
+// stagedName returns the name of the output of a reduce task before it is published.
+func stagedName(dataDir, jobName string, reduceTask int) string {
+	return path.Join(stagingDir(dataDir, jobName), "res-"+strconv.Itoa(reduceTask))
+}
+
+// successName returns the name of the _SUCCESS manifest of a job.
+func successName(dataDir, jobName string) string {
+	return path.Join(dataDir, "mrtmp."+jobName+"-_SUCCESS")
+}
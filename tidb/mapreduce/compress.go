@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Compression is the codec compressing the intermediate files.
+type Compression int
+
+const (
+	// NoCompression writes the intermediate files as they are encoded, it is the default.
+	NoCompression Compression = iota
+	// GzipCompression compresses the intermediate files in the gzip format.
+	GzipCompression
+	// FlateCompression compresses the intermediate files in the raw DEFLATE format.
+	FlateCompression
+)
+
+const (
+	// codecBufferSize is the size of the buffer between a codec and the records.
+	codecBufferSize = 256 << 10
+	// readBufferSize is the size of the buffer reading an intermediate file,
+	// the buffers of the files merged at once may be smaller down to minReadBufferSize.
+	readBufferSize    = 64 << 10
+	minReadBufferSize = 4 << 10
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case GzipCompression:
+		return "gzip"
+	case FlateCompression:
+		return "flate"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// checkLevel returns an error if c can not compress at level.
+func (c Compression) checkLevel(level int) error {
+	switch c {
+	case NoCompression:
+		return nil
+	case GzipCompression, FlateCompression:
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return fmt.Errorf("invalid %v compression level %d", c, level)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown compression %v", c)
+}
+
+// newWriter returns a writer compressing into w at level, it returns nil if
+// c is NoCompression.
+func (c Compression) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	switch c {
+	case NoCompression:
+		return nil, nil
+	case GzipCompression:
+		return gzip.NewWriterLevel(w, level)
+	case FlateCompression:
+		return flate.NewWriter(w, level)
+	}
+	return nil, fmt.Errorf("unknown compression %v", c)
+}
+
+// newReader returns a reader decompressing r, it returns nil if c is NoCompression.
+func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case NoCompression:
+		return nil, nil
+	case GzipCompression:
+		return gzip.NewReader(r)
+	case FlateCompression:
+		return flate.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression %v", c)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// intermediateWriter writes the records of an intermediate file through the
+// codec of its job.
+type intermediateWriter struct {
+	kvWriter
+	f    *os.File
+	fbuf *bufio.Writer  // buffers f
+	zw   io.WriteCloser // compresses into fbuf, nil if not compressed
+	raw  *countingWriter
+	buf  *bufio.Writer // buffers the records before zw
+}
+
+func createIntermediate(name string, format IntermediateFormat, compression Compression, level int) (*intermediateWriter, error) {
+	f, fbuf, err := createFileAndBuf(name)
+	if err != nil {
+		return nil, err
+	}
+	w := &intermediateWriter{f: f, fbuf: fbuf}
+	if w.zw, err = compression.newWriter(fbuf, level); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if w.zw == nil {
+		w.kvWriter = format.newWriter(fbuf)
+		return w, nil
+	}
+	w.raw = &countingWriter{w: w.zw}
+	w.buf = bufio.NewWriterSize(w.raw, codecBufferSize)
+	w.kvWriter = format.newWriter(w.buf)
+	return w, nil
+}
+
+// rawBytes returns how many bytes are written before they are compressed,
+// ok is false if the file is not compressed.
+func (w *intermediateWriter) rawBytes() (n int64, ok bool) {
+	if w.raw == nil {
+		return 0, false
+	}
+	return w.raw.n, true
+}
+
+// Close flushes the records and closes the file.
+func (w *intermediateWriter) Close() error {
+	var err error
+	if w.zw != nil {
+		err = w.buf.Flush()
+		if cerr := w.zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := closeFileAndBuf(w.f, w.fbuf); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// intermediateReader reads the records of an intermediate file through the
+// codec of its job.
+type intermediateReader struct {
+	kvReader
+	f  *os.File
+	zr io.ReadCloser // decompresses f, nil if not compressed
+}
+
+// openIntermediate opens an intermediate file, which is read through buffers
+// of bufSize bytes.
+func openIntermediate(name string, format IntermediateFormat, compression Compression, bufSize int) (*intermediateReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewReaderSize(f, bufSize)
+	r := &intermediateReader{f: f}
+	if r.zr, err = compression.newReader(buf); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read %s: %v", name, err)
+	}
+	if r.zr == nil {
+		r.kvReader = format.newReader(buf)
+	} else {
+		r.kvReader = format.newReader(bufio.NewReaderSize(r.zr, bufSize))
+	}
+	return r, nil
+}
+
+// Close closes the file.
+func (r *intermediateReader) Close() error {
+	if r.zr != nil {
+		r.zr.Close()
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// ContextMapF is a StreamMapF which also receives the context of its task,
+// the context is done when the task is given up and carries the counters
+// incremented by IncCounter.
+type ContextMapF func(ctx context.Context, filename string, r io.Reader, emit Emitter) error
+
+// ContextReduceF is a ReduceF which also receives the context of its task,
+// see ContextMapF.
+type ContextReduceF func(ctx context.Context, key string, values []string) string
+
+// withContext adapts this StreamMapF to a ContextMapF ignoring the context.
+func (f StreamMapF) withContext() ContextMapF {
+	return func(ctx context.Context, filename string, r io.Reader, emit Emitter) error {
+		return f(filename, r, emit)
+	}
+}
+
+// withContext adapts this ReduceF to a ContextReduceF ignoring the context.
+func (f ReduceF) withContext() ContextReduceF {
+	return func(ctx context.Context, key string, values []string) string {
+		return f(key, values)
+	}
+}
+
+// taskCounters holds the counters of an attempt.
+type taskCounters struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+type countersKey struct{}
+
+// withCounters returns a context carrying new counters.
+func withCounters(ctx context.Context) (context.Context, *taskCounters) {
+	counters := &taskCounters{m: make(map[string]int64)}
+	return context.WithValue(ctx, countersKey{}, counters), counters
+}
+
+// snapshot returns the counters incremented so far, it is nil if there is none.
+func (c *taskCounters) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) == 0 {
+		return nil
+	}
+	m := make(map[string]int64, len(c.m))
+	for name, value := range c.m {
+		m[name] = value
+	}
+	return m
+}
+
+// IncCounter adds delta to the counter called name of the task running with
+// ctx, it does nothing if ctx is not the context of a task. The counters of
+// the successful attempt of each task are summed up in JobMetrics.Counters,
+// the ones of failed or abandoned attempts are dropped.
+func IncCounter(ctx context.Context, name string, delta int64) {
+	counters, ok := ctx.Value(countersKey{}).(*taskCounters)
+	if !ok {
+		return
+	}
+	counters.mu.Lock()
+	counters.m[name] += delta
+	counters.mu.Unlock()
+}
+
+// sumCounters sums up the counters of tasks.
+func sumCounters(metrics ...[]TaskMetrics) map[string]int64 {
+	sum := make(map[string]int64)
+	for _, ms := range metrics {
+		for _, m := range ms {
+			for name, value := range m.Counters {
+				sum[name] += value
+			}
+		}
+	}
+	return sum
+}
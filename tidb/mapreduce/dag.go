@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DAG is a graph of rounds, each round reads the files of named sources and
+// the outputs of other rounds. The rounds are added after the nodes they
+// read, so a DAG has no cycles.
+//
+// The outputs of round name of the job jobName are the files
+// mrtmp.<jobName>-<name>-res-N, a map function reading several nodes can
+// tell them apart by the names of its input files.
+type DAG struct {
+	nodes  map[string]*dagNode
+	rounds []*dagNode // in the order they are added
+	err    error      // the first error building the graph
+}
+
+type dagNode struct {
+	name    string
+	files   []string // the files of a source
+	round   *RoundArgs
+	inputs  []string // the nodes read by a round
+	readers int      // how many times the node is read by the rounds
+}
+
+// NewDAG returns an empty DAG.
+func NewDAG() *DAG {
+	return &DAG{nodes: make(map[string]*dagNode)}
+}
+
+// Source adds a node named name for the source files.
+func (g *DAG) Source(name string, files ...string) *DAG {
+	g.add(&dagNode{name: name, files: files})
+	return g
+}
+
+// Round adds a node named name running round on the files of the nodes
+// named inputs, which must have been added.
+func (g *DAG) Round(name string, round RoundArgs, inputs ...string) *DAG {
+	if len(inputs) == 0 && g.err == nil {
+		g.err = fmt.Errorf("mapreduce: round %s reads no nodes", name)
+	}
+	for _, input := range inputs {
+		n, ok := g.nodes[input]
+		if !ok {
+			if g.err == nil {
+				g.err = fmt.Errorf("mapreduce: round %s reads unknown node %s", name, input)
+			}
+			continue
+		}
+		n.readers++
+	}
+	g.add(&dagNode{name: name, round: &round, inputs: inputs})
+	return g
+}
+
+func (g *DAG) add(n *dagNode) {
+	if _, ok := g.nodes[n.name]; ok {
+		if g.err == nil {
+			g.err = fmt.Errorf("mapreduce: duplicate node %s", n.name)
+		}
+		return
+	}
+	g.nodes[n.name] = n
+	if n.round != nil {
+		g.rounds = append(g.rounds, n)
+	}
+}
+
+// DAGResult is the result of running a DAG.
+type DAGResult struct {
+	// Outputs are the outputs of the rounds read by no other round, by the names of the rounds.
+	Outputs map[string][]string
+	// Metrics are the metrics of the finished rounds, by the names of the rounds.
+	Metrics map[string]*JobMetrics
+}
+
+// Run runs the rounds of this DAG on a cluster, a round is submitted as the
+// job "<jobName>-<name>" with opts as soon as the rounds it reads succeed, so
+// the independent rounds run at the same time. The outputs of a round are
+// removed once all the rounds reading them finish. If a round fails, the
+// running rounds are canceled and the error of the failed round is returned
+// together with the metrics of the finished rounds.
+func (g *DAG) Run(ctx context.Context, c *MRCluster, jobName, dataDir string, opts ...JobOption) (*DAGResult, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type state struct {
+		done    chan struct{}
+		outputs []string
+		ok      bool
+		readers int // how many readers have not finished
+	}
+	states := make(map[string]*state, len(g.rounds))
+	for _, n := range g.rounds {
+		states[n.name] = &state{done: make(chan struct{}), readers: n.readers}
+	}
+	result := &DAGResult{Outputs: make(map[string][]string), Metrics: make(map[string]*JobMetrics)}
+	var (
+		mu  sync.Mutex
+		err error
+		wg  sync.WaitGroup
+	)
+	// release records that a reader of a round finishes, the outputs of the
+	// round are removed after its last reader.
+	release := func(name string) {
+		s := states[name]
+		mu.Lock()
+		s.readers--
+		last := s.readers == 0
+		mu.Unlock()
+		if last {
+			removeOutputs(dataDir, jobName+"-"+name, s.outputs)
+		}
+	}
+	for _, n := range g.rounds {
+		wg.Add(1)
+		go func(n *dagNode) {
+			defer wg.Done()
+			s := states[n.name]
+			defer close(s.done)
+			var files []string
+			for _, input := range n.inputs {
+				if src := g.nodes[input]; src.round == nil {
+					files = append(files, src.files...)
+					continue
+				}
+				defer release(input)
+				in := states[input]
+				<-in.done
+				if !in.ok {
+					return
+				}
+				files = append(files, in.outputs...)
+			}
+
+			r := n.round
+			job := c.SubmitStream(ctx, jobName+"-"+n.name, dataDir, r.StreamMapF(), r.ReduceFunc, files, r.NReduce, append([]JobOption{WithCombiner(r.CombineFunc)}, opts...)...)
+			outputs, jerr := job.Wait()
+			mu.Lock()
+			defer mu.Unlock()
+			result.Metrics[n.name] = job.Metrics()
+			if jerr != nil {
+				// 只返回最先失败的轮次的错误，其余轮次是被取消的
+				if err == nil {
+					err = fmt.Errorf("round %s of %s: %v", n.name, jobName, jerr)
+					cancel()
+				}
+				return
+			}
+			s.outputs, s.ok = outputs, true
+			if n.readers == 0 {
+				result.Outputs[n.name] = outputs
+			}
+		}(n)
+	}
+	wg.Wait()
+	return result, err
+}
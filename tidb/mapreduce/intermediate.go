@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// IntermediateFormat is the encoding of the key/value records in the intermediate files.
+type IntermediateFormat int
+
+const (
+	// BinaryFormat prefixes keys and values by their lengths in varint,
+	// it is safe for arbitrary keys and values. It is the default format.
+	BinaryFormat IntermediateFormat = iota
+	// TextFormat writes a record as a "key+value\n" line, the keys must not
+	// contain '+' and neither keys nor values can contain '\n'.
+	TextFormat
+)
+
+// maxRecordFieldLen limits the length of a key or value read from an intermediate
+// file, so that a corrupted length can not make the reader allocate too much memory.
+const maxRecordFieldLen = 1 << 30
+
+type kvWriter interface {
+	Write(kv KeyValue) error
+}
+
+type kvReader interface {
+	// Read returns io.EOF if there are no more records.
+	Read() (KeyValue, error)
+}
+
+func (f IntermediateFormat) newWriter(w *bufio.Writer) kvWriter {
+	if f == TextFormat {
+		return textKVWriter{w}
+	}
+	return NewKVWriter(w)
+}
+
+func (f IntermediateFormat) newReader(r *bufio.Reader) kvReader {
+	if f == TextFormat {
+		return textKVReader{r}
+	}
+	return NewKVReader(r)
+}
+
+// KVWriter writes key/value records in BinaryFormat.
+type KVWriter struct {
+	w       io.Writer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+// NewKVWriter returns a KVWriter writing to w, w should be buffered.
+func NewKVWriter(w io.Writer) *KVWriter {
+	return &KVWriter{w: w}
+}
+
+// Write writes a record.
+func (w *KVWriter) Write(kv KeyValue) error {
+	if err := w.writeString(kv.Key); err != nil {
+		return err
+	}
+	return w.writeString(kv.Value)
+}
+
+func (w *KVWriter) writeString(s string) error {
+	n := binary.PutUvarint(w.scratch[:], uint64(len(s)))
+	if _, err := w.w.Write(w.scratch[:n]); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.w, s)
+	return err
+}
+
+// KVReader reads key/value records written by KVWriter.
+type KVReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// NewKVReader returns a KVReader reading from r.
+func NewKVReader(r *bufio.Reader) *KVReader {
+	return &KVReader{r: r}
+}
+
+// Read reads a record, it returns io.EOF if there are no more records
+// and io.ErrUnexpectedEOF if the last record is truncated.
+func (r *KVReader) Read() (KeyValue, error) {
+	key, err := r.readString()
+	if err != nil {
+		return KeyValue{}, err
+	}
+	value, err := r.readString()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return KeyValue{}, err
+	}
+	return KeyValue{Key: key, Value: value}, nil
+}
+
+func (r *KVReader) readString() (string, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxRecordFieldLen {
+		return "", fmt.Errorf("record field of %d bytes is too large", n)
+	}
+	if uint64(cap(r.buf)) < n {
+		r.buf = make([]byte, n)
+	}
+	buf := r.buf[:n]
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(buf), nil
+}
+
+type textKVWriter struct {
+	w *bufio.Writer
+}
+
+func (w textKVWriter) Write(kv KeyValue) error {
+	_, err := w.w.WriteString(kv.Key + kvSplitChar + kv.Value + "\n")
+	return err
+}
+
+type textKVReader struct {
+	r *bufio.Reader
+}
+
+func (r textKVReader) Read() (KeyValue, error) {
+	for {
+		line, err := r.r.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return KeyValue{}, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		i := strings.Index(line, kvSplitChar)
+		if i < 0 {
+			continue
+		}
+		return KeyValue{Key: line[:i], Value: line[i+len(kvSplitChar):]}, nil
+	}
+}
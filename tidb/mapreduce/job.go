@@ -0,0 +1,325 @@
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrTaskTimeout is the error of a task which runs longer than the limit set by WithTaskTimeout.
+	ErrTaskTimeout = errors.New("task exceeded its deadline")
+	// ErrWorkerLost is the error of an attempt whose worker process stops
+	// heartbeating, the attempt is re-executed by another worker.
+	ErrWorkerLost = errors.New("worker lost")
+)
+
+// Job is a handle of a job submitted to a MRCluster.
+type Job struct {
+	name    string
+	done    chan struct{}
+	outputs []string
+	err     error
+	metrics *JobMetrics
+
+	// where the files of the job are, set before its tasks are scheduled
+	cfg           *jobConfig
+	dataDir       string
+	nMap, nReduce int
+
+	mapProgress, reduceProgress phaseProgress
+}
+
+func newJob(name string) *Job {
+	return &Job{
+		name:    name,
+		done:    make(chan struct{}),
+		metrics: &JobMetrics{Name: name, Start: time.Now()},
+	}
+}
+
+// Name returns the name of this job.
+func (j *Job) Name() string { return j.name }
+
+// Done returns a channel which is closed when this job is finished.
+func (j *Job) Done() <-chan struct{} { return j.done }
+
+// Wait waits for this job to finish and returns its output files,
+// the error is not nil if any task of this job failed. The output files are
+// published together with a _SUCCESS manifest after all reduce tasks succeed,
+// see ReadSuccessManifest.
+func (j *Job) Wait() ([]string, error) {
+	<-j.done
+	return j.outputs, j.err
+}
+
+// Err returns the error of this job, it is nil until the job is finished.
+func (j *Job) Err() error {
+	select {
+	case <-j.done:
+		return j.err
+	default:
+		return nil
+	}
+}
+
+// Metrics returns the metrics of the tasks of this job which have succeeded,
+// it is nil until the job is finished. The metrics of a successful job are
+// also written as JSON to mrtmp.<job name>-metrics.json in its data dir.
+func (j *Job) Metrics() *JobMetrics {
+	select {
+	case <-j.done:
+		return j.metrics
+	default:
+		return nil
+	}
+}
+
+// Counters returns the sums of the counters incremented by the successful
+// attempts of the tasks of this job, it is nil until the job is finished.
+func (j *Job) Counters() map[string]int64 {
+	if m := j.Metrics(); m != nil {
+		return m.Counters
+	}
+	return nil
+}
+
+func (j *Job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// status returns the status of this job shown by the status page.
+func (j *Job) status() JobStatus {
+	s := JobStatus{
+		Name:   j.name,
+		State:  "running",
+		Start:  j.metrics.Start,
+		Map:    j.mapProgress.snapshot(),
+		Reduce: j.reduceProgress.snapshot(),
+	}
+	if j.finished() {
+		s.State, s.End = "succeeded", j.metrics.End
+		if j.err != nil {
+			s.State, s.Err = "failed", j.err.Error()
+		}
+	}
+	return s
+}
+
+func (j *Job) finish(outputs []string, err error) {
+	if j.metrics.End.IsZero() {
+		j.metrics.finish()
+	}
+	j.outputs, j.err = outputs, err
+	close(j.done)
+}
+
+// TaskError records a failed map or reduce task.
+type TaskError struct {
+	JobName    string
+	Phase      jobPhase
+	TaskNumber int
+	Attempts   int
+	Err        error // the error of the last attempt
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("job %s: %s task %d failed after %d attempt(s): %v", e.JobName, e.Phase, e.TaskNumber, e.Attempts, e.Err)
+}
+
+// JobOption configures a job submitted to a MRCluster.
+type JobOption func(*jobConfig)
+
+type jobConfig struct {
+	taskTimeout      time.Duration
+	maxAttempts      int
+	retryBackoff     time.Duration
+	combineF         CombineF
+	partitioner      Partitioner
+	format           IntermediateFormat
+	compression      Compression
+	compressionLevel int
+	memoryBudget     int64 // how many bytes a task holds records in, not positive is unlimited
+	splitSize        int64
+	tempDir          string
+	mapFName         string // the registered name of the map function
+	reduceFName      string // the registered name of the reduce function
+
+	speculation    float64 // how many times slower than the median a straggler is, 0 disables speculation
+	speculationMin time.Duration
+	traceFile      string
+	trace          *jobTrace // nil if the job is not traced
+	priority       int
+	weight         float64
+	queue          *jobQueue          // where the attempts of the job wait for workers
+	remoteErrs     map[jobPhase]error // why the tasks of each phase can not be run by worker processes
+	checkpointing  bool
+	checkpoint     *checkpoint // nil if the job is not checkpointed
+	retention      RetentionPolicy
+	err            error // the first invalid option, the job fails at once if it is not nil
+}
+
+func newJobConfig(clusterOpts Options, dataDir string, opts []JobOption) *jobConfig {
+	cfg := &jobConfig{
+		maxAttempts:      1,
+		weight:           1,
+		partitioner:      HashPartitioner{},
+		format:           clusterOpts.Format,
+		compressionLevel: flate.DefaultCompression,
+		memoryBudget:     defaultMemoryBudget,
+		tempDir:          clusterOpts.TempDir,
+	}
+	if cfg.tempDir == "" {
+		cfg.tempDir = dataDir
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.traceFile != "" {
+		cfg.trace = newJobTrace(cfg.traceFile)
+	}
+	return cfg
+}
+
+// WithTaskTimeout fails the tasks of a job which run longer than d,
+// zero means there is no limit.
+func WithTaskTimeout(d time.Duration) JobOption {
+	return func(cfg *jobConfig) { cfg.taskTimeout = d }
+}
+
+// WithRetry attempts a failed task up to maxAttempts times in total. The
+// first retry waits for backoff and the wait doubles for each following retry.
+func WithRetry(maxAttempts int, backoff time.Duration) JobOption {
+	return func(cfg *jobConfig) {
+		if maxAttempts > 0 {
+			cfg.maxAttempts = maxAttempts
+		}
+		cfg.retryBackoff = backoff
+	}
+}
+
+// backoff returns how long to wait before the retry following n failed attempts.
+func (cfg *jobConfig) backoff(n int) time.Duration {
+	return cfg.retryBackoff << uint(n-1)
+}
+
+// WithCombiner merges the values of the same key emitted by a map task by
+// combineF before they are shuffled, nil means no combiner.
+func WithCombiner(combineF CombineF) JobOption {
+	return func(cfg *jobConfig) { cfg.combineF = combineF }
+}
+
+// WithPartitioner sends the keys of a job to reduce tasks by p instead of HashPartitioner.
+func WithPartitioner(p Partitioner) JobOption {
+	return func(cfg *jobConfig) {
+		if p != nil {
+			cfg.partitioner = p
+		}
+	}
+}
+
+// WithIntermediateFormat encodes the intermediate files of a job in format
+// instead of the default format of the cluster.
+func WithIntermediateFormat(format IntermediateFormat) JobOption {
+	return func(cfg *jobConfig) { cfg.format = format }
+}
+
+// WithCompression compresses the intermediate files of a job by compression
+// at level, which is one of the levels of compress/flate such as
+// flate.BestSpeed, flate.DefaultCompression and flate.BestCompression.
+// The files are decompressed transparently by the reduce tasks. A job with
+// an invalid level fails at once.
+func WithCompression(compression Compression, level int) JobOption {
+	return func(cfg *jobConfig) {
+		if err := compression.checkLevel(level); err != nil && cfg.err == nil {
+			cfg.err = fmt.Errorf("mapreduce: %v", err)
+		}
+		cfg.compression, cfg.compressionLevel = compression, level
+	}
+}
+
+// WithSplitSize cuts the input files into splits of about size bytes at line
+// boundaries and runs one map task for each split, so that a large file can
+// be mapped in parallel. Each file is mapped by one task if size is not positive.
+func WithSplitSize(size int64) JobOption {
+	return func(cfg *jobConfig) { cfg.splitSize = size }
+}
+
+// WithMemoryBudget bounds the memory a task holds records in to about bytes,
+// it is defaultMemoryBudget by default and unlimited if bytes is not positive.
+//
+// A map task spills the records exceeding the budget to disk as sorted runs,
+// which are merged into the intermediate files after the map function
+// returns. A reduce task k-way merges the sorted intermediate files of its
+// partition and holds the values of one key at a time, the values of a key
+// exceeding the budget are combined by the combiner of the job.
+//
+// The values of a key are only bounded if the job has a combiner set by
+// WithCombiner: ReduceF takes all values of a key at once, so without a
+// combiner they are held in memory however large they are, and a warning is
+// logged when they exceed the budget. A job with hot keys needs a combiner
+// not to run out of memory.
+//
+// Sorted files are merged 64 at a time at most, more files are merged in
+// several passes. The read buffers of the files merged at once take about
+// half of the budget.
+func WithMemoryBudget(bytes int64) JobOption {
+	return func(cfg *jobConfig) { cfg.memoryBudget = bytes }
+}
+
+// WithSpeculation launches a backup attempt of a task running slowdown times
+// longer than the median run time of the finished tasks in its phase, and at
+// least minRuntime. The attempt finishing first wins and the outputs of the
+// other one are discarded. Speculation is disabled if slowdown is not positive.
+func WithSpeculation(slowdown float64, minRuntime time.Duration) JobOption {
+	return func(cfg *jobConfig) {
+		cfg.speculation, cfg.speculationMin = slowdown, minRuntime
+	}
+}
+
+// WithTrace writes the timeline of a job to fileName in the Chrome trace_event
+// format when the job is finished, which can be loaded by chrome://tracing.
+// Each worker is shown as a thread with a span for each attempt it runs, the
+// spans of the successful attempts are broken down into their steps.
+func WithTrace(fileName string) JobOption {
+	return func(cfg *jobConfig) { cfg.traceFile = fileName }
+}
+
+// WithPriority runs the tasks of a job before the ones of the jobs with lower
+// priorities whenever a worker is free, the default priority is 0.
+func WithPriority(priority int) JobOption {
+	return func(cfg *jobConfig) { cfg.priority = priority }
+}
+
+// WithWeight sets the weight of a job among the jobs with the same priority,
+// which share the workers in proportion to their weights. The default weight
+// is 1, weight is ignored if it is not positive.
+func WithWeight(weight float64) JobOption {
+	return func(cfg *jobConfig) {
+		if weight > 0 {
+			cfg.weight = weight
+		}
+	}
+}
+
+// WithCheckpoint records the completed tasks of a job and the checksums of
+// their outputs in mrtmp.<job name>-manifest.json in its data dir. If the job
+// is submitted again with the same name, inputs and settings, the tasks whose
+// outputs are intact are skipped and the job resumes from the other ones.
+// The manifest and the intermediate files of a checkpointed job are kept
+// after it finishes, until they are removed by MRCluster.Cleanup.
+func WithCheckpoint() JobOption {
+	return func(cfg *jobConfig) { cfg.checkpointing = true }
+}
+
+// WithRetention sets when the intermediate files of a job are deleted, they
+// are deleted once the job finishes by default. See RetentionPolicy.
+func WithRetention(policy RetentionPolicy) JobOption {
+	return func(cfg *jobConfig) { cfg.retention = policy }
+}
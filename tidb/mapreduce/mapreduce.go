@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"runtime"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // KeyValue is a type used to hold the key/value pairs passed to the map and reduce functions.
@@ -26,6 +28,43 @@ type ReduceF func(key string, values []string) string
 // MapF function from MIT 6.824 LAB1
 type MapF func(filename string, contents string) []KeyValue
 
+// Emitter receives the key/value pairs produced by a StreamMapF, a StreamMapF
+// should stop and return the error if Emitter returns one.
+type Emitter func(kv KeyValue) error
+
+// StreamMapF is a map function reading its input from r and emitting the
+// key/value pairs as soon as they are produced, so that the input does not
+// need to be held in memory.
+type StreamMapF func(filename string, r io.Reader, emit Emitter) error
+
+// Stream adapts this MapF to a StreamMapF, the whole input is read into memory
+// before f is called.
+func (f MapF) Stream() StreamMapF {
+	return func(filename string, r io.Reader, emit Emitter) error {
+		var content []byte
+		var err error
+		if sized, ok := r.(interface{ Size() int64 }); ok {
+			content = make([]byte, sized.Size())
+			_, err = io.ReadFull(r, content)
+		} else {
+			content, err = ioutil.ReadAll(r)
+		}
+		if err != nil {
+			return err
+		}
+		for _, kv := range f(filename, BytesToString(content)) {
+			if err := emit(kv); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// CombineF merges the values of a key emitted by a map task into one value,
+// it runs before the key/value pairs are written to the intermediate files.
+type CombineF func(key string, values []string) string
+
 // jobPhase indicates whether a task is scheduled as a map or reduce task.
 type jobPhase string
 
@@ -35,43 +74,134 @@ const (
 )
 
 var (
-	kvSplitChar = "+"
+	kvSplitChar = "+" // separates keys and values in TextFormat
+)
+
+// taskStatus indicates whether a task is finished successfully or not.
+type taskStatus int
+
+const (
+	taskPending taskStatus = iota
+	taskDone
+	taskFailed
 )
 
 type task struct {
 	dataDir    string
 	jobName    string
-	mapFile    string   // only for map, the input file
-	phase      jobPhase // are we in mapPhase or reducePhase?
-	taskNumber int      // this task's index in the current phase
-	nMap       int      // number of map tasks
-	nReduce    int      // number of reduce tasks
-	mapF       MapF     // map function used in this job
-	reduceF    ReduceF  // reduce function used in this job
-	wg         sync.WaitGroup
+	mapFile    string         // only for map, the input file
+	split      inputSplit     // only for map, the range of mapFile read by this task
+	phase      jobPhase       // are we in mapPhase or reducePhase?
+	taskNumber int            // this task's index in the current phase
+	nMap       int            // number of map tasks
+	nReduce    int            // number of reduce tasks
+	mapF       ContextMapF    // map function used in this job
+	reduceF    ContextReduceF // reduce function used in this job
+	ctx        context.Context
+	cfg        *jobConfig
+	status     taskStatus
+	attempts   int            // how many times this task has been attempted
+	err        error          // why this task failed
+	done       chan struct{}  // closed when this task is finished
+	recovery   *mapRecovery   // only for reduce, re-executes the map tasks whose outputs are lost
+	progress   *phaseProgress // counts the finished tasks of the phase, nil for re-executions
+	stats      *phaseStats    // the run times of the finished tasks in the same phase
+	metrics    TaskMetrics    // the metrics of the successful attempt
+	published  bool           // only for reduce, the task is resumed from its published output
+
+	mu        sync.Mutex
+	committer uint64 // the id of the attempt committing its outputs, 0 if none
+}
+
+// taskAttempt is one execution of a task, a failed task may be attempted several times.
+type taskAttempt struct {
+	*task
+	id        uint64          // unique in a cluster
+	number    int             // starts from 1
+	errCh     chan error      // receives the result of this attempt
+	ctx       context.Context // done when the task is canceled or this attempt is given up
+	cancel    context.CancelFunc
+	startedAt int64       // when a worker starts running this attempt in unix nanoseconds, 0 before that
+	pid, tid  int         // the process and the worker running this attempt
+	metrics   TaskMetrics // filled if this attempt succeeds
+}
+
+func (t *task) finish(err error) {
+	if err != nil {
+		t.status, t.err = taskFailed, err
+	} else {
+		t.status = taskDone
+	}
+	if t.progress != nil {
+		t.progress.finish(err)
+	}
+	close(t.done)
+}
+
+// Options configures a MRCluster.
+type Options struct {
+	NWorkers  int                // how many workers there are, defaults to runtime.NumCPU()
+	QueueSize int                // how many tasks of each job can wait for a free worker, 0 is unlimited
+	TempDir   string             // where the intermediate files are written, defaults to the data dir of each job
+	Format    IntermediateFormat // the default format of the intermediate files
+
+	// RemoteOnly starts no worker goroutines, the tasks are only run by the
+	// worker processes connected to the address served by MRCluster.Serve.
+	RemoteOnly bool
+	// WorkerLease is how long a worker process is considered alive after it
+	// is heard from, defaults to 10 seconds.
+	WorkerLease time.Duration
 }
 
 // MRCluster represents a map-reduce cluster.
 type MRCluster struct {
-	nWorkers int
-	wg       sync.WaitGroup
-	taskCh   chan *task
-	exit     chan struct{}
-}
+	opts      Options
+	nWorkers  int
+	wg        sync.WaitGroup
+	sched     *scheduler
+	exit      chan struct{}
+	attemptID uint64 // the last id assigned to an attempt
+
+	busy int32 // how many worker goroutines are running attempts
 
-var singleton = &MRCluster{
-	nWorkers: runtime.NumCPU(),
-	taskCh:   make(chan *task),
-	exit:     make(chan struct{}),
+	mu           sync.Mutex
+	master       *master      // serves the worker processes, nil if Serve is not called
+	statusServer *http.Server // serves the status page, nil if ServeStatus is not called
+	jobs         []*Job       // the running and recently finished jobs
+	failures     []AttemptFailure
+	running      map[string]int    // how many jobs of each name are running
+	dataDirs     map[string]string // the data dirs of the latest submitted jobs by their names
 }
 
-func init() {
-	singleton.Start()
+// NewMRCluster creates a MRCluster and starts it.
+func NewMRCluster(opts Options) *MRCluster {
+	if opts.NWorkers <= 0 {
+		opts.NWorkers = runtime.NumCPU()
+	}
+	c := &MRCluster{
+		opts:     opts,
+		nWorkers: opts.NWorkers,
+		sched:    newScheduler(opts.QueueSize),
+		exit:     make(chan struct{}),
+		running:  make(map[string]int),
+		dataDirs: make(map[string]string),
+	}
+	c.Start()
+	return c
 }
 
-// GetMRCluster returns a reference to a MRCluster.
+var (
+	defaultCluster     *MRCluster
+	defaultClusterOnce sync.Once
+)
+
+// GetMRCluster returns a reference to the default MRCluster,
+// it is created with the default Options on the first call.
 func GetMRCluster() *MRCluster {
-	return singleton
+	defaultClusterOnce.Do(func() {
+		defaultCluster = NewMRCluster(Options{})
+	})
+	return defaultCluster
 }
 
 // NWorkers returns how many workers there are in this cluster.
@@ -79,73 +209,254 @@ func (c *MRCluster) NWorkers() int { return c.nWorkers }
 
 // Start starts this cluster.
 func (c *MRCluster) Start() {
+	if c.opts.RemoteOnly {
+		return
+	}
 	for i := 0; i < c.nWorkers; i++ {
 		c.wg.Add(1)
-		go c.worker()
+		go c.worker(i + 1)
 	}
 }
 
-func (c *MRCluster) worker() {
+func (c *MRCluster) worker(id int) {
 	defer c.wg.Done()
+	pid := os.Getpid()
 	for {
-		select {
-		case t := <-c.taskCh:
-			if t.phase == mapPhase {
-				// 准备文件的读写对象
-				fs := make([]*os.File, t.nReduce)
-				bs := make([]*bufio.Writer, t.nReduce)
-				for i := range fs {
-					fs[i], bs[i] = CreateFileAndBuf(reduceName(t.dataDir, t.jobName, t.taskNumber, i))
-				}
-				// 从文件读取数据并执行mapF()，将mapF()的结果存储到对应的文件中
-				content, err := ioutil.ReadFile(t.mapFile)
-				PanicErr(err)
-				results := t.mapF(t.mapFile, BytesToString(content))
-				// 用map存储不同key设置唯一一个ihash()值，减少ihash()的调用
-				bsIndexMap := make(map[string]int)
-				for _, kv := range results {
-					if _, ok := bsIndexMap[kv.Key]; !ok {
-						bsIndexMap[kv.Key] = ihash(kv.Key) % t.nReduce
-					}
-					fmt.Fprintf(bs[bsIndexMap[kv.Key]], "%s\n", kv.Key+kvSplitChar+kv.Value)
-				}
-				// 关闭文件读写对象
-				for i := range fs {
-					SafeClose(fs[i], bs[i])
-				}
-			} else {
-				mergeFileName := mergeName(t.dataDir, t.jobName, t.taskNumber)
-				fs, bs := CreateFileAndBuf(mergeFileName)
-				var kvMap = make(map[string][]string, t.nMap)
-				// shuffle处理
-				for index := 0; index < t.nMap; index++ {
-					fileName := reduceName(t.dataDir, t.jobName, index, t.taskNumber)
-					content, err := ioutil.ReadFile(fileName)
-					PanicErr(err)
-					bytesLines := bytes.Split(content, []byte("\n"))
-					for _, bytesLine := range bytesLines {
-						if len(bytesLine) == 0 || len(bytesLine) == len(kvSplitChar) {
-							continue
-						}
-						kvSlice := strings.Split(BytesToString(bytesLine), kvSplitChar)
-						if len(kvSlice) <= 1 {
-							continue
-						}
-						kvMap[kvSlice[0]] = append(kvMap[kvSlice[0]], kvSlice[1])
-					}
-				}
-				// 写入文件
-				buffer := make([]string, 0, len(kvMap))
-				for key, values := range kvMap {
-					buffer = append(buffer, t.reduceF(key, values))
+		a := c.sched.next(c.exit, nil, nil)
+		if a == nil {
+			return
+		}
+		a.start(pid, id)
+		atomic.AddInt32(&c.busy, 1)
+		err := runTask(a)
+		atomic.AddInt32(&c.busy, -1)
+		a.errCh <- err
+	}
+}
+
+// runTask runs an attempt of a task. An attempt exceeding its deadline fails
+// at once, and so does an attempt whose job is canceled, the worker is
+// released without waiting for the user function to return.
+func runTask(a *taskAttempt) error {
+	if err := a.ctx.Err(); err != nil {
+		// the job has been canceled while this task was queued
+		return err
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+
+	var m TaskMetrics
+	errCh := make(chan error, 1)
+	go func() { errCh <- doTask(ctx, a.task, a.number, a.claim, &m) }()
+	err := a.await(ctx, errCh)
+	if err == nil {
+		a.metrics = m
+	}
+	return err
+}
+
+// context returns the context of this attempt, which is done when the job
+// is canceled or the attempt exceeds its deadline.
+func (a *taskAttempt) context() (context.Context, context.CancelFunc) {
+	if a.cfg.taskTimeout > 0 {
+		return context.WithTimeout(a.ctx, a.cfg.taskTimeout)
+	}
+	return context.WithCancel(a.ctx)
+}
+
+// await waits for the result of this attempt from errCh, it returns at once
+// if ctx created by a.context() is done.
+func (a *taskAttempt) await(ctx context.Context, errCh <-chan error) error {
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		if err := a.ctx.Err(); err != nil {
+			return err
+		}
+		return ErrTaskTimeout
+	}
+}
+
+// doTask runs a map or reduce task, a panic raised by the task is recovered
+// and returned as an error so that it can not crash the whole process.
+// The outputs are written to attempt-scoped files first and only renamed to
+// their final names if the attempt succeeds before ctx is done and claim
+// allows it, claim allows only one attempt of a task to commit. The metrics
+// of the attempt are recorded in m.
+func doTask(ctx context.Context, t *task, attempt int, claim func() bool, m *TaskMetrics) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if t.phase == mapPhase {
+		return doMap(ctx, t, attempt, claim, m)
+	}
+	return doReduce(ctx, t, attempt, claim, m)
+}
+
+func doMap(ctx context.Context, t *task, attempt int, claim func() bool, m *TaskMetrics) (err error) {
+	// 流式读取文件并执行mapF()，将mapF()的结果按分区存储，用map存储不同key对应的分区，减少Partition()的调用
+	input, err := os.Open(t.mapFile)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	length := t.split.length
+	if length < 0 {
+		stat, err := input.Stat()
+		if err != nil {
+			return err
+		}
+		length = stat.Size()
+	}
+	m.InputBytes = length
+	buf := newMapBuffer(t, attempt)
+	defer buf.remove()
+	emit := func(kv KeyValue) error {
+		m.Records++
+		return buf.add(kv)
+	}
+	mapCtx, counters := withCounters(ctx)
+	start := time.Now()
+	err = t.mapF(mapCtx, t.mapFile, io.NewSectionReader(input, t.split.offset, length), emit)
+	if err == nil {
+		err = buf.flush()
+	}
+	m.Counters = counters.snapshot()
+	m.Spills = buf.spills
+	m.Spans = append(m.Spans, Span{Name: "map", Start: start, End: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// 准备文件的读写对象，所有文件名都在注册defer之前确定
+	names := make([]string, t.nReduce)
+	for i := range names {
+		names[i] = reduceName(t.cfg.tempDir, t.jobName, t.taskNumber, i)
+	}
+	ws := make([]*intermediateWriter, t.nReduce)
+	defer func() {
+		// 关闭文件读写对象，成功后再重命名为最终的文件名
+		for i := range ws {
+			if ws[i] == nil {
+				continue
+			}
+			if cerr := ws[i].Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err == nil {
+			m.PartitionBytes = make([]int64, len(names))
+			for i, name := range names {
+				m.PartitionBytes[i] = fileSize(attemptName(name, attempt))
+				if raw, ok := ws[i].rawBytes(); ok {
+					m.RawIntermediateBytes += raw
+				} else {
+					m.RawIntermediateBytes += m.PartitionBytes[i]
 				}
-				_, err := bs.WriteString(strings.Join(buffer, ""))
-				PanicErr(err)
-				SafeClose(fs, bs)
 			}
-			t.wg.Done()
-		case <-c.exit:
-			return
+		}
+		err = commitAttempt(ctx, names, attempt, claim, err)
+		m.Spans = append(m.Spans, Span{Name: "partition write", Start: start, End: time.Now()})
+	}()
+	start = time.Now()
+	for i := range ws {
+		if ws[i], err = createIntermediate(attemptName(names[i], attempt), t.cfg.format, t.cfg.compression, t.cfg.compressionLevel); err != nil {
+			return err
+		}
+	}
+	// 每个分区先合并再排序后写入对应的文件，有溢写时归并溢写的有序文件
+	for i := range ws {
+		if err := buf.write(i, ws[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// combine merges the values of the same key by combineF.
+func combine(kvs []KeyValue, combineF CombineF) []KeyValue {
+	kvMap := make(map[string][]string)
+	for _, kv := range kvs {
+		kvMap[kv.Key] = append(kvMap[kv.Key], kv.Value)
+	}
+	combined := make([]KeyValue, 0, len(kvMap))
+	for key, values := range kvMap {
+		combined = append(combined, KeyValue{Key: key, Value: combineF(key, values)})
+	}
+	return combined
+}
+
+func doReduce(ctx context.Context, t *task, attempt int, claim func() bool, m *TaskMetrics) (err error) {
+	// shuffle处理：归并nMap个按key排序的文件，每次只对一个key调用reduceF()
+	fileNames := make([]string, t.nMap)
+	for index := range fileNames {
+		fileNames[index] = reduceName(t.cfg.tempDir, t.jobName, index, t.taskNumber)
+	}
+	start := time.Now()
+	// 超过mergeFanIn个文件时先分批归并，中间结果以map任务0的文件命名，随中间文件一起清理
+	runName := func(run int) string {
+		return mergeRunName(reduceName(t.cfg.tempDir, t.jobName, 0, t.taskNumber), attempt, run)
+	}
+	mr, err := openMergeReader(fileNames, t.cfg, runName)
+	if err != nil {
+		return err
+	}
+	defer mr.Close()
+	mr.bound(t.cfg.combineF, t.cfg.memoryBudget)
+	m.InputBytes = mr.Size()
+	reduceCtx, counters := withCounters(ctx)
+
+	// 写入文件，读取和归约交替进行，分别累计它们的耗时
+	readTime, reduceTime := time.Since(start), time.Duration(0)
+	name := stagedName(t.dataDir, t.jobName, t.taskNumber)
+	fs, bs, err := createFileAndBuf(attemptName(name, attempt))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		m.Counters = counters.snapshot()
+		if cerr := closeFileAndBuf(fs, bs); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			m.OutputBytes = fileSize(attemptName(name, attempt))
+		}
+		err = commitAttempt(ctx, []string{name}, attempt, claim, err)
+		// 交替进行的读取、归约和写入按累计的耗时依次排列
+		readEnd := start.Add(readTime)
+		reduceEnd := readEnd.Add(reduceTime)
+		m.Spans = append(m.Spans,
+			Span{Name: "shuffle read", Start: start, End: readEnd},
+			Span{Name: "reduce", Start: readEnd, End: reduceEnd},
+			Span{Name: "reduce write", Start: reduceEnd, End: time.Now()},
+		)
+	}()
+	for {
+		readStart := time.Now()
+		key, values, err := mr.NextGroup()
+		readTime += time.Since(readStart)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m.Keys++
+		m.Records += int64(len(values))
+		reduceStart := time.Now()
+		output := t.reduceF(reduceCtx, key, values)
+		reduceTime += time.Since(reduceStart)
+		if _, err := bs.WriteString(output); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 	}
 }
@@ -153,63 +464,390 @@ func (c *MRCluster) worker() {
 // Shutdown shutdowns this cluster.
 func (c *MRCluster) Shutdown() {
 	close(c.exit)
+	c.mu.Lock()
+	if c.master != nil {
+		c.master.close()
+	}
+	c.mu.Unlock()
+	c.closeStatus()
 	c.wg.Wait()
 }
 
-// Submit submits a job to this cluster.
-func (c *MRCluster) Submit(jobName, dataDir string, mapF MapF, reduceF ReduceF, mapFiles []string, nReduce int) <-chan []string {
-	notify := make(chan []string)
-	go c.run(jobName, dataDir, mapF, reduceF, mapFiles, nReduce, notify)
-	return notify
+// Submit submits a job to this cluster, the returned Job reports the
+// output files of the job or the error which makes the job failed.
+func (c *MRCluster) Submit(jobName, dataDir string, mapF MapF, reduceF ReduceF, mapFiles []string, nReduce int, opts ...JobOption) *Job {
+	return c.SubmitContext(context.Background(), jobName, dataDir, mapF, reduceF, mapFiles, nReduce, opts...)
+}
+
+// SubmitContext is like Submit but the job is aborted once ctx is done:
+// no more tasks are scheduled, queued tasks are abandoned, the files written
+// by this job are removed and the job reports ctx.Err().
+func (c *MRCluster) SubmitContext(ctx context.Context, jobName, dataDir string, mapF MapF, reduceF ReduceF, mapFiles []string, nReduce int, opts ...JobOption) *Job {
+	return c.submit(ctx, jobName, dataDir, mapF.Stream().withContext(), funcName(mapF), reduceF.withContext(), funcName(reduceF), mapFiles, nReduce, opts)
+}
+
+// SubmitStream is like SubmitContext but the map function reads its input as a stream.
+func (c *MRCluster) SubmitStream(ctx context.Context, jobName, dataDir string, mapF StreamMapF, reduceF ReduceF, mapFiles []string, nReduce int, opts ...JobOption) *Job {
+	return c.submit(ctx, jobName, dataDir, mapF.withContext(), funcName(mapF), reduceF.withContext(), funcName(reduceF), mapFiles, nReduce, opts)
 }
 
-func (c *MRCluster) run(jobName, dataDir string, mapF MapF, reduceF ReduceF, mapFiles []string, nReduce int, notify chan<- []string) {
-	// map phase
-	nMap := len(mapFiles)
+// SubmitContextFuncs is like SubmitStream but the map and reduce functions
+// receive the contexts of their tasks, so that they can increment counters
+// by IncCounter, which are returned by Job.Counters.
+func (c *MRCluster) SubmitContextFuncs(ctx context.Context, jobName, dataDir string, mapF ContextMapF, reduceF ContextReduceF, mapFiles []string, nReduce int, opts ...JobOption) *Job {
+	return c.submit(ctx, jobName, dataDir, mapF, funcName(mapF), reduceF, funcName(reduceF), mapFiles, nReduce, opts)
+}
+
+// submit starts a job, mapFName and reduceFName are the names of the
+// functions registered by RegisterFuncs, which are used to run the tasks in
+// worker processes.
+func (c *MRCluster) submit(ctx context.Context, jobName, dataDir string, mapF ContextMapF, mapFName string, reduceF ContextReduceF, reduceFName string, mapFiles []string, nReduce int, opts []JobOption) *Job {
+	job := newJob(jobName)
+	cfg := newJobConfig(c.opts, dataDir, opts)
+	if cfg.err != nil {
+		job.finish(nil, cfg.err)
+		return job
+	}
+	cfg.mapFName, cfg.reduceFName = mapFName, reduceFName
+	cfg.remoteErrs = map[jobPhase]error{mapPhase: cfg.remoteError(mapPhase), reducePhase: cfg.remoteError(reducePhase)}
+	cfg.queue = c.sched.newQueue(cfg.priority, cfg.weight)
+	c.track(job)
+	c.mu.Lock()
+	c.running[jobName]++
+	c.dataDirs[jobName] = dataDir
+	c.mu.Unlock()
+	go c.run(ctx, job, cfg, dataDir, mapF, reduceF, mapFiles, nReduce)
+	return job
+}
+
+func (c *MRCluster) run(ctx context.Context, job *Job, cfg *jobConfig, dataDir string, mapF ContextMapF, reduceF ContextReduceF, mapFiles []string, nReduce int) {
+	// map phase, one map task for each input split
+	splits, err := planSplits(mapFiles, cfg.splitSize)
+	if err != nil {
+		c.finishJob(job, cfg, nil, err)
+		return
+	}
+	nMap := len(splits)
+	job.cfg, job.dataDir, job.nMap, job.nReduce = cfg, dataDir, nMap, nReduce
+	if cfg.checkpointing {
+		fp, err := newJobFingerprint(cfg, mapFiles, nMap, nReduce)
+		if err == nil {
+			cfg.checkpoint, err = openCheckpoint(manifestName(dataDir, job.name), job.name, fp)
+		}
+		if err != nil {
+			c.finishJob(job, cfg, nil, fmt.Errorf("open checkpoint: %v", err))
+			return
+		}
+	}
+	stats := new(phaseStats)
+	phaseStart := time.Now()
+	job.mapProgress.start(nMap)
 	tasks := make([]*task, 0, nMap)
 	for i := 0; i < nMap; i++ {
 		t := &task{
 			dataDir:    dataDir,
-			jobName:    jobName,
-			mapFile:    mapFiles[i],
+			jobName:    job.name,
+			mapFile:    splits[i].file,
+			split:      splits[i],
 			phase:      mapPhase,
 			taskNumber: i,
 			nReduce:    nReduce,
 			nMap:       nMap,
 			mapF:       mapF,
+			ctx:        ctx,
+			cfg:        cfg,
+			done:       make(chan struct{}),
+			stats:      stats,
+			progress:   &job.mapProgress,
 		}
-		t.wg.Add(1)
 		tasks = append(tasks, t)
-		go func() { c.taskCh <- t }()
+		c.resumeOrSchedule(t)
 	}
-	for _, t := range tasks {
-		t.wg.Wait()
+	err = waitTasks(ctx, tasks)
+	job.metrics.Map = collectMetrics(tasks)
+	cfg.tracePhase(mapPhase, phaseStart)
+	if err != nil {
+		c.abort(ctx, job, cfg, dataDir, nMap, nReduce, err)
+		return
 	}
-	
+
 	// reduce phase
+	if err := os.MkdirAll(stagingDir(dataDir, job.name), 0755); err != nil {
+		c.finishJob(job, cfg, nil, err)
+		return
+	}
+	recovery := newMapRecovery(c, tasks)
+	stats = new(phaseStats)
+	phaseStart = time.Now()
+	job.reduceProgress.start(nReduce)
 	tasks = make([]*task, 0, nReduce)
 	for index := 0; index < nReduce; index++ {
 		t := &task{
 			dataDir:    dataDir,
-			jobName:    jobName,
+			jobName:    job.name,
 			phase:      reducePhase,
 			taskNumber: index,
 			nReduce:    nReduce,
 			nMap:       nMap,
 			reduceF:    reduceF,
+			ctx:        ctx,
+			cfg:        cfg,
+			done:       make(chan struct{}),
+			recovery:   recovery,
+			stats:      stats,
+			progress:   &job.reduceProgress,
 		}
-		t.wg.Add(1)
 		tasks = append(tasks, t)
-		go func() { c.taskCh <- t }()
+		c.resumeOrSchedule(t)
+	}
+	err = waitTasks(ctx, tasks)
+	job.metrics.Map = collectMetrics(recovery.latest())
+	job.metrics.Reduce = collectMetrics(tasks)
+	cfg.tracePhase(reducePhase, phaseStart)
+	if err != nil {
+		c.abort(ctx, job, cfg, dataDir, nMap, nReduce, err)
+		return
+	}
+	job.metrics.finish()
+	if err := writeMetricsReport(metricsName(dataDir, job.name), job.metrics); err != nil {
+		c.finishJob(job, cfg, nil, err)
+		return
+	}
+	m, err := commitJob(dataDir, job.name, tasks)
+	if err != nil {
+		c.finishJob(job, cfg, nil, fmt.Errorf("commit outputs: %v", err))
+		return
+	}
+	if cfg.checkpoint != nil {
+		if err := cfg.checkpoint.publish(m.Outputs); err != nil {
+			c.finishJob(job, cfg, nil, fmt.Errorf("record checkpoint: %v", err))
+			return
+		}
+	}
+	outputs := make([]string, 0, len(m.Outputs))
+	for _, f := range m.Outputs {
+		outputs = append(outputs, f.Name)
+	}
+	c.finishJob(job, cfg, outputs, nil)
+}
+
+// schedule runs a task until it succeeds or runs out of attempts,
+// the task is abandoned if its job is canceled.
+//
+// An attempt given up because its worker is lost, or because the outputs of
+// a map task it reads are lost, is re-executed without counting as a failure,
+// but a task is attempted maxReexecutions more times than its retry limit at most.
+func (c *MRCluster) schedule(t *task) {
+	var err error
+	failures := 0
+	for failures < t.cfg.maxAttempts && t.attempts < t.cfg.maxAttempts+maxReexecutions {
+		if failures > 0 && err != nil {
+			// 重试前等待一段时间
+			select {
+			case <-time.After(t.cfg.backoff(failures)):
+			case <-t.ctx.Done():
+				t.finish(t.ctx.Err())
+				return
+			}
+		}
+		if err = c.runAttempts(t); err == nil {
+			if t.cfg.checkpoint != nil {
+				if cerr := t.cfg.checkpoint.record(t); cerr != nil {
+					err = fmt.Errorf("record checkpoint: %v", cerr)
+				}
+			}
+			break
+		}
+		if t.ctx.Err() != nil {
+			break
+		}
+		if err == ErrWorkerLost {
+			continue
+		}
+		if lost, ok := err.(*mapOutputLostError); ok && t.recovery != nil {
+			// 重新执行输出丢失的map任务后再重试
+			if err = t.recovery.rerun(lost.mapTask); err != nil {
+				break
+			}
+			continue
+		}
+		failures++
+	}
+	t.finish(err)
+}
+
+// runAttempts runs an attempt of a task, and a backup attempt if the task
+// becomes a straggler of its phase while speculation is enabled. The first
+// attempt succeeding wins and the other one is given up, it returns the error
+// of the last attempt if all of them fail.
+func (c *MRCluster) runAttempts(t *task) error {
+	results := make(chan error, 2)
+	launch := func() *taskAttempt {
+		t.attempts++
+		ctx, cancel := context.WithCancel(t.ctx)
+		a := &taskAttempt{
+			task:   t,
+			id:     atomic.AddUint64(&c.attemptID, 1),
+			number: t.attempts,
+			errCh:  make(chan error, 1),
+			ctx:    ctx,
+			cancel: cancel,
+		}
+		go func() {
+			err := c.attempt(a)
+			if t.cfg.trace != nil {
+				t.cfg.trace.attempt(a, time.Now(), err)
+			}
+			if err != nil {
+				a.unclaim()
+				c.recordFailure(a, err)
+			} else {
+				a.metrics.Start, a.metrics.End = time.Unix(0, atomic.LoadInt64(&a.startedAt)), time.Now()
+				t.metrics = a.metrics
+				if t.stats != nil {
+					t.stats.record(a.metrics.Duration())
+				}
+			}
+			results <- err
+		}()
+		return a
+	}
+	attempts := []*taskAttempt{launch()}
+	defer func() {
+		for _, a := range attempts {
+			a.cancel()
+		}
+	}()
+
+	var check <-chan time.Time
+	if t.cfg.speculation > 0 {
+		ticker := time.NewTicker(speculationInterval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	var err error
+	for pending := 1; pending > 0; {
+		select {
+		case err = <-results:
+			if err == nil {
+				return nil
+			}
+			pending--
+		case <-check:
+			// 只为每个任务启动一个备份执行，且备份执行的编号不能超过重试的上限
+			if len(attempts) == 1 && t.attempts < t.cfg.maxAttempts+maxReexecutions && attempts[0].straggling() {
+				attempts = append(attempts, launch())
+				pending++
+				check = nil
+			}
+		}
 	}
-	notifies := make([]string, 0, nReduce)
+	return err
+}
+
+// resumeOrSchedule finishes a task at once if it has been completed by a
+// previous submission of a checkpointed job, or schedules it otherwise.
+func (c *MRCluster) resumeOrSchedule(t *task) {
+	if t.cfg.checkpoint != nil && t.cfg.checkpoint.completed(t) {
+		t.finish(nil)
+		return
+	}
+	go c.schedule(t)
+}
+
+// attempt queues an attempt of a task for a worker and waits for its result,
+// the attempt is dropped from the queue if it is given up before a worker
+// takes it.
+func (c *MRCluster) attempt(a *taskAttempt) error {
+	if !c.sched.push(a) {
+		return a.ctx.Err()
+	}
+	select {
+	case err := <-a.errCh:
+		c.sched.done(a)
+		return err
+	case <-a.ctx.Done():
+		if c.sched.remove(a) {
+			return a.ctx.Err()
+		}
+	}
+	err := <-a.errCh
+	c.sched.done(a)
+	return err
+}
+
+// abort finishes a failed job, the intermediate files of a canceled job are
+// removed. The outputs of a job are only published after all of its tasks
+// succeed, so the outputs published by an earlier run of the same job are
+// kept. A canceled checkpointed job keeps its manifest and the committed
+// outputs of its tasks to resume from, only the files of its attempts are
+// removed.
+func (c *MRCluster) abort(ctx context.Context, job *Job, cfg *jobConfig, dataDir string, nMap, nReduce int, err error) {
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		if cfg.checkpointing {
+			removeAttemptLeftovers(cfg, dataDir, job.name, nMap, nReduce)
+		} else {
+			removeIntermediateFiles(cfg, dataDir, job.name, nMap, nReduce)
+		}
+	}
+	c.finishJob(job, cfg, nil, err)
+}
+
+// finishJob finishes a job after its trace is written, the intermediate
+// files of the job are removed unless its retention policy keeps them.
+func (c *MRCluster) finishJob(job *Job, cfg *jobConfig, outputs []string, err error) {
+	if cfg.trace != nil {
+		if terr := cfg.trace.write(job.name); terr != nil && err == nil {
+			outputs, err = nil, fmt.Errorf("write trace: %v", terr)
+		}
+	}
+	if !cfg.retains(err) {
+		job.removeIntermediate()
+	}
+	c.mu.Lock()
+	if c.running[job.name]--; c.running[job.name] == 0 {
+		delete(c.running, job.name)
+	}
+	c.mu.Unlock()
+	job.finish(outputs, err)
+}
+
+// waitTasks waits for all tasks to finish and returns the error of the first failed one,
+// it returns ctx.Err() without waiting for the running tasks if ctx is done.
+func waitTasks(ctx context.Context, tasks []*task) error {
+	var err error
 	for _, t := range tasks {
-		t.wg.Wait()
-		mergedFileName := mergeName(t.dataDir, t.jobName, t.taskNumber)
-		notifies = append(notifies, mergedFileName)
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if t.status == taskFailed && err == nil {
+			err = &TaskError{JobName: t.jobName, Phase: t.phase, TaskNumber: t.taskNumber, Attempts: t.attempts, Err: t.err}
+		}
 	}
-	
-	notify <- notifies
+	return err
+}
+
+// commitAttempt renames the files written by a successful attempt to their
+// final names, the files are removed instead if the attempt failed or
+// another attempt of the same task has committed.
+func commitAttempt(ctx context.Context, names []string, attempt int, claim func() bool, err error) error {
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && !claim() {
+		err = errCommitDenied
+	}
+	for _, name := range names {
+		if err != nil {
+			os.Remove(attemptName(name, attempt))
+			continue
+		}
+		err = os.Rename(attemptName(name, attempt), name)
+	}
+	return err
 }
 
 func ihash(s string) int {
@@ -225,3 +863,12 @@ func reduceName(dataDir, jobName string, mapTask int, reduceTask int) string {
 func mergeName(dataDir, jobName string, reduceTask int) string {
 	return path.Join(dataDir, "mrtmp."+jobName+"-res-"+strconv.Itoa(reduceTask))
 }
+
+func attemptName(name string, attempt int) string {
+	return name + ".attempt-" + strconv.Itoa(attempt)
+}
+
+// mergeRunName returns the name of a sorted run merged by an attempt of a reduce task.
+func mergeRunName(name string, attempt, run int) string {
+	return attemptName(name, attempt) + ".merge-" + strconv.Itoa(run)
+}
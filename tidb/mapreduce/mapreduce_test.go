@@ -0,0 +1,1466 @@
+package main
+
+import (
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// makeTestInputs writes contents into files under a temporary directory,
+// it returns the directory and the paths of these files.
+func makeTestInputs(t *testing.T, contents ...string) (string, []string) {
+	dir, err := ioutil.TempDir("", "mr_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make([]string, 0, len(contents))
+	for i, c := range contents {
+		fpath := path.Join(dir, fmt.Sprintf("inputMapFile%d", i))
+		if err := ioutil.WriteFile(fpath, []byte(c), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fpath)
+	}
+	return dir, files
+}
+
+// readOutputs reads and concatenates the output files of a job.
+func readOutputs(t *testing.T, files []string) string {
+	var sb strings.Builder
+	for _, f := range files {
+		c, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb.Write(c)
+	}
+	return sb.String()
+}
+
+func TestSubmitReportsTaskError(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	missing := append([]string{path.Join(dir, "notExist")}, files...)
+	_, err := mr.Submit("MissingInput", dir, URLCountMap, URLCountReduce, missing, 2).Wait()
+	if te, ok := err.(*TaskError); !ok || te.Phase != mapPhase || te.TaskNumber != 0 {
+		t.Fatalf("expected the error of map task 0, but got: %v", err)
+	}
+
+	panicMap := func(filename string, contents string) []KeyValue { panic("bad input") }
+	if _, err := mr.Submit("PanicMap", dir, panicMap, URLCountReduce, files, 2).Wait(); err == nil {
+		t.Fatalf("expected the panic in MapF to be reported")
+	}
+
+	// the cluster still works after the failed jobs
+	outputs, err := mr.Submit("AfterFailure", dir, URLCountMap, URLCountReduce, files, 2).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); !strings.Contains(got, "a 1\n") || !strings.Contains(got, "b 1\n") {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+}
+
+func TestSubmitContextCancel(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\n", "b\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	hangMap := func(filename string, contents string) []KeyValue {
+		<-release
+		return nil
+	}
+	job := mr.SubmitContext(ctx, "Cancel", dir, hangMap, URLCountReduce, files, 2)
+	cancel()
+	if _, err := job.Wait(); err != context.Canceled {
+		t.Fatalf("expected %v, but got: %v", context.Canceled, err)
+	}
+	if matches, _ := filepath.Glob(path.Join(dir, "mrtmp.Cancel-*")); len(matches) != 0 {
+		t.Fatalf("files of the canceled job are left: %v", matches)
+	}
+}
+
+func TestTaskTimeout(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\n")
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	defer close(release)
+	hangMap := func(filename string, contents string) []KeyValue {
+		<-release
+		return nil
+	}
+	job := GetMRCluster().Submit("Timeout", dir, hangMap, URLCountReduce, files, 1, WithTaskTimeout(50*time.Millisecond))
+	_, err := job.Wait()
+	if te, ok := err.(*TaskError); !ok || te.Err != ErrTaskTimeout {
+		t.Fatalf("expected %v, but got: %v", ErrTaskTimeout, err)
+	}
+}
+
+func TestTaskRetry(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\n")
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	flakyMap := func(filename string, contents string) []KeyValue {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			panic("flaky")
+		}
+		return URLCountMap(filename, contents)
+	}
+	job := GetMRCluster().Submit("Retry", dir, flakyMap, URLCountReduce, files, 2, WithRetry(3, time.Millisecond))
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); !strings.Contains(got, "a 2\n") || !strings.Contains(got, "b 1\n") {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	if matches, _ := filepath.Glob(path.Join(dir, "*.attempt-*")); len(matches) != 0 {
+		t.Fatalf("files of the failed attempts are left: %v", matches)
+	}
+
+	alwaysFail := func(filename string, contents string) []KeyValue { panic("bad input") }
+	_, err = GetMRCluster().Submit("RetryFail", dir, alwaysFail, URLCountReduce, files, 2, WithRetry(2, 0)).Wait()
+	if te, ok := err.(*TaskError); !ok || te.Attempts != 2 {
+		t.Fatalf("expected the task to fail after 2 attempts, but got: %v", err)
+	}
+}
+
+func TestCombiner(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\na\na\nb\n")
+	defer os.RemoveAll(dir)
+
+	job := GetMRCluster().Submit("Combine", dir, URLCountMap, URLCountReduce, files, 1, WithCombiner(URLCountCombine), WithRetention(KeepIntermediate))
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); !strings.Contains(got, "a 3\n") || !strings.Contains(got, "b 1\n") {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	var kvs []KeyValue
+	if err := readIntermediate(reduceName(dir, "Combine", 0, 0), BinaryFormat, NoCompression, func(kv KeyValue) { kvs = append(kvs, kv) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 {
+		t.Fatalf("expected 2 combined records, but got: %v", kvs)
+	}
+}
+
+func TestRangePartitioner(t *testing.T) {
+	dir, files := makeTestInputs(t, "c\na\nd\nb\n")
+	defer os.RemoveAll(dir)
+
+	job := GetMRCluster().Submit("Range", dir, URLCountMap, URLCountReduce, files, 2, WithPartitioner(NewRangePartitioner("c")))
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs[:1]); !strings.Contains(got, "a 1\n") || !strings.Contains(got, "b 1\n") || len(got) != 8 {
+		t.Fatalf("unexpected outputs of reduce task 0: %q", got)
+	}
+	if got := readOutputs(t, outputs[1:]); !strings.Contains(got, "c 1\n") || !strings.Contains(got, "d 1\n") || len(got) != 8 {
+		t.Fatalf("unexpected outputs of reduce task 1: %q", got)
+	}
+
+	bad := PartitionFunc(func(key string, nReduce int) int { return nReduce })
+	if _, err := GetMRCluster().Submit("BadPartition", dir, URLCountMap, URLCountReduce, files, 2, WithPartitioner(bad)).Wait(); err == nil {
+		t.Fatalf("expected an out of range partition to fail the job")
+	}
+}
+
+func TestBinaryFormat(t *testing.T) {
+	dir, files := makeTestInputs(t, "unused")
+	defer os.RemoveAll(dir)
+
+	kvs := []KeyValue{{"a+b", "1"}, {"line\nbreak", "x+y"}, {"", ""}, {"a+b", "2"}}
+	mapF := func(filename string, contents string) []KeyValue { return kvs }
+	reduceF := func(key string, values []string) string {
+		return fmt.Sprintf("%q %q\n", key, values)
+	}
+	outputs, err := GetMRCluster().Submit("Binary", dir, mapF, reduceF, files, 1).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readOutputs(t, outputs)
+	for _, expected := range []string{`"a+b" ["1" "2"]`, `"line\nbreak" ["x+y"]`, `"" [""]`} {
+		if !strings.Contains(got, expected) {
+			t.Fatalf("expected %s in outputs: %s", expected, got)
+		}
+	}
+}
+
+func TestSortedShuffle(t *testing.T) {
+	dir, files := makeTestInputs(t, "d\nb\nd\n", "c\na\n", "b\n")
+	defer os.RemoveAll(dir)
+
+	outputs, err := GetMRCluster().Submit("Sorted", dir, URLCountMap, URLCountReduce, files, 1).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 1\nb 2\nc 1\nd 2\n" {
+		t.Fatalf("expected the keys to be reduced in order, but got: %q", got)
+	}
+}
+
+func TestStreamMap(t *testing.T) {
+	long := strings.Repeat("x", 2*MB)
+	dir, files := makeTestInputs(t, "a\nb\na\n", " c \n\n"+long+"\nc")
+	defer os.RemoveAll(dir)
+
+	job := GetMRCluster().SubmitStream(context.Background(), "Stream", dir, URLCountStreamMap, URLCountReduce, files, 1)
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\nc 2\n"+long+" 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+}
+
+func TestInputSplits(t *testing.T) {
+	content := "aa\nbbbb\nc\n\ndddddd\nee"
+	dir, files := makeTestInputs(t, content, "")
+	defer os.RemoveAll(dir)
+
+	splits, err := planSplits(files, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range splits[:len(splits)-1] {
+		got = append(got, content[s.offset:s.offset+s.length])
+	}
+	expected := []string{"aa\nbbbb\n", "c\n\ndddddd\n", "ee"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) || splits[len(splits)-1] != (inputSplit{file: files[1]}) {
+		t.Fatalf("expected splits %q, but got %q and %v", expected, got, splits[len(splits)-1])
+	}
+
+	job := GetMRCluster().Submit("Split", dir, URLCountMap, URLCountReduce, files, 2, WithSplitSize(4))
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); len(got) != len("aa 1\nbbbb 1\nc 1\ndddddd 1\nee 1\n") {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+}
+
+func TestNewMRCluster(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\n")
+	defer os.RemoveAll(dir)
+	tempDir := path.Join(dir, "tmp")
+	mr := NewMRCluster(Options{NWorkers: 1, QueueSize: 4, TempDir: tempDir, Format: TextFormat})
+	defer mr.Shutdown()
+
+	if mr.NWorkers() != 1 {
+		t.Fatalf("expected 1 worker, but got %d", mr.NWorkers())
+	}
+	outputs, err := mr.Submit("Isolated", dir, URLCountMap, URLCountReduce, files, 1, WithRetention(KeepIntermediate)).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	if got := readOutputs(t, []string{reduceName(tempDir, "Isolated", 1, 0)}); got != "a+1\n" {
+		t.Fatalf("expected a text intermediate file in the temp dir, but got: %q", got)
+	}
+}
+
+// TestHelperWorkerProcess is not a real test, it runs a worker process for
+// the tests starting worker processes by re-executing the test binary.
+func TestHelperWorkerProcess(t *testing.T) {
+	address := os.Getenv("MR_WORKER_MASTER")
+	if address == "" {
+		return
+	}
+	if os.Getenv("MR_WORKER_CRASH") != "" {
+		testHookBeforeTask = func(spec *TaskSpec) { os.Exit(3) }
+	}
+	if err := RunWorker("unix", address); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// startWorkerProcesses starts n worker processes connected to address.
+func startWorkerProcesses(t *testing.T, address string, n int, env ...string) []*exec.Cmd {
+	cmds := make([]*exec.Cmd, 0, n)
+	for i := 0; i < n; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=TestHelperWorkerProcess")
+		cmd.Env = append(append(os.Environ(), "MR_WORKER_MASTER="+address), env...)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+func TestWorkerProcesses(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n", "a\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{NWorkers: 2, RemoteOnly: true})
+	addr, err := mr.Serve("unix", path.Join(dir, "master.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := startWorkerProcesses(t, addr.String(), 2)
+
+	job := mr.Submit("Remote", dir, URLCountMap, URLCountReduce, files, 2, WithCombiner(URLCountCombine))
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); len(got) != len("a 3\nb 1\nc 1\n") || !strings.Contains(got, "a 3\n") {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	var keys int64
+	for _, m := range job.Metrics().Reduce {
+		keys += m.Keys
+	}
+	if keys != 3 {
+		t.Fatalf("expected 3 keys reduced by the worker processes, but got %d", keys)
+	}
+
+	job = mr.SubmitContextFuncs(context.Background(), "RemoteCounters", dir, countingMap, countingReduce, files, 2)
+	if _, err := job.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if counters := job.Counters(); counters["lines"] != 5 || counters["keys"] != 3 {
+		t.Fatalf("unexpected counters: %v", counters)
+	}
+
+	closure := func(filename string, contents string) []KeyValue { return nil }
+	if _, err := mr.Submit("Unregistered", dir, closure, URLCountReduce, files, 2).Wait(); err == nil {
+		t.Fatalf("expected the job using an unregistered function to fail")
+	}
+
+	mr.Shutdown()
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("the worker process exits with: %v", err)
+		}
+	}
+}
+
+func TestWorkerCrash(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{RemoteOnly: true, WorkerLease: 300 * time.Millisecond})
+	addr, err := mr.Serve("unix", path.Join(dir, "master.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := startWorkerProcesses(t, addr.String(), 1, "MR_WORKER_CRASH=1")
+	job := mr.Submit("Crash", dir, URLCountMap, URLCountReduce, files, 1)
+	if err := crashed[0].Wait(); err == nil {
+		t.Fatalf("expected the worker process to crash")
+	}
+	cmds := startWorkerProcesses(t, addr.String(), 1)
+
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\nc 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	mr.Shutdown()
+	for _, cmd := range cmds {
+		cmd.Wait()
+	}
+}
+
+func TestWorkerStall(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{RemoteOnly: true, WorkerLease: 200 * time.Millisecond})
+	addr, err := mr.Serve("unix", path.Join(dir, "master.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first worker getting a task stalls until the job is finished
+	var stalled int32
+	release := make(chan struct{})
+	testHookBeforeTask = func(spec *TaskSpec) {
+		if atomic.CompareAndSwapInt32(&stalled, 0, 1) {
+			<-release
+		}
+	}
+	defer func() { testHookBeforeTask = nil }()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RunWorker("unix", addr.String())
+		}()
+	}
+
+	outputs, err := mr.Submit("Stall", dir, URLCountMap, URLCountReduce, files, 1).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\nc 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	close(release)
+	mr.Shutdown()
+	wg.Wait()
+}
+
+func TestLostMapOutput(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{NWorkers: 2})
+	defer mr.Shutdown()
+
+	// map task 1 removes the output of map task 0 once it is committed
+	var once sync.Once
+	lostMap := func(filename string, contents string) []KeyValue {
+		if filename == files[1] {
+			once.Do(func() {
+				name := reduceName(dir, "Lost", 0, 0)
+				for i := 0; i < 500 && !FileOrDirExist(name); i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				os.Remove(name)
+			})
+		}
+		return URLCountMap(filename, contents)
+	}
+	outputs, err := mr.Submit("Lost", dir, lostMap, URLCountReduce, files, 1).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\nc 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+}
+
+func TestSpeculation(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\n", "b\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{NWorkers: 4})
+	defer mr.Shutdown()
+
+	// the first attempt of the last map task hangs until the job is finished
+	var stalled int32
+	release := make(chan struct{})
+	slowMap := func(filename string, contents string) []KeyValue {
+		if filename == files[2] && atomic.CompareAndSwapInt32(&stalled, 0, 1) {
+			<-release
+		}
+		return URLCountMap(filename, contents)
+	}
+	job := mr.Submit("Speculation", dir, slowMap, URLCountReduce, files, 1, WithSpeculation(2, 100*time.Millisecond))
+	outputs, err := job.Wait()
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\nc 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+}
+
+func TestJobMetrics(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+
+	job := GetMRCluster().Submit("Metrics", dir, URLCountMap, URLCountReduce, files, 2)
+	if _, err := job.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	metrics := job.Metrics()
+	if len(metrics.Map) != 2 || len(metrics.Reduce) != 2 {
+		t.Fatalf("expected metrics of 2 map and 2 reduce tasks, but got %d and %d", len(metrics.Map), len(metrics.Reduce))
+	}
+	var inputBytes, records, intermediateBytes int64
+	for _, m := range metrics.Map {
+		if m.Attempts != 1 || m.Start.IsZero() || m.End.Before(m.Start) {
+			t.Fatalf("unexpected map task metrics: %+v", m)
+		}
+		inputBytes += m.InputBytes
+		records += m.Records
+		for _, size := range m.PartitionBytes {
+			intermediateBytes += size
+		}
+	}
+	if inputBytes != 8 || records != 4 {
+		t.Fatalf("expected 8 input bytes and 4 records mapped, but got %d and %d", inputBytes, records)
+	}
+	var reduceBytes, reduceRecords, keys int64
+	for _, m := range metrics.Reduce {
+		reduceBytes += m.InputBytes
+		reduceRecords += m.Records
+		keys += m.Keys
+	}
+	if reduceBytes != intermediateBytes || reduceRecords != 4 || keys != 3 {
+		t.Fatalf("unexpected reduce task metrics: %+v", metrics.Reduce)
+	}
+
+	data, err := ioutil.ReadFile(metricsName(dir, "Metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report JobMetrics
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Name != "Metrics" || len(report.Map) != 2 || len(report.Reduce) != 2 {
+		t.Fatalf("unexpected report: %s", data)
+	}
+}
+
+func init() {
+	RegisterFuncs(countingMap, countingReduce)
+}
+
+// countingMap is URLCountStreamMap counting the lines it reads.
+func countingMap(ctx context.Context, filename string, r io.Reader, emit Emitter) error {
+	return URLCountStreamMap(filename, r, func(kv KeyValue) error {
+		IncCounter(ctx, "lines", 1)
+		return emit(kv)
+	})
+}
+
+// countingReduce is URLCountReduce counting the keys it reduces.
+func countingReduce(ctx context.Context, key string, values []string) string {
+	IncCounter(ctx, "keys", 1)
+	return URLCountReduce(key, values)
+}
+
+func TestCounters(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+
+	job := GetMRCluster().SubmitContextFuncs(context.Background(), "Counters", dir, countingMap, countingReduce, files, 2)
+	if _, err := job.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if counters := job.Counters(); len(counters) != 2 || counters["lines"] != 4 || counters["keys"] != 3 {
+		t.Fatalf("unexpected counters: %v", counters)
+	}
+	var lines int64
+	for _, m := range job.Metrics().Map {
+		lines += m.Counters["lines"]
+	}
+	if lines != 4 {
+		t.Fatalf("expected 4 lines counted by the map tasks, but got %d", lines)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+
+	traceFile := path.Join(dir, "trace.json")
+	job := GetMRCluster().Submit("Trace", dir, URLCountMap, URLCountReduce, files, 2, WithTrace(traceFile))
+	if _, err := job.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(data, &trace); err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]int)
+	for _, e := range trace.TraceEvents {
+		names[e.Cat+"/"+e.Name]++
+	}
+	for name, n := range map[string]int{
+		"attempt/mapPhase":         2,
+		"attempt/reducePhase":      2,
+		"phase/mapPhase":           1,
+		"phase/reducePhase":        1,
+		"reducePhase/shuffle read": 2,
+		"reducePhase/reduce":       2,
+		"reducePhase/reduce write": 2,
+	} {
+		if names[name] != n {
+			t.Fatalf("expected %d %s events, but got %d: %v", n, name, names[name], names)
+		}
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{NWorkers: 2})
+	defer mr.Shutdown()
+	if _, err := mr.ServeStatus("0.0.0.0:0"); err == nil {
+		t.Fatalf("expected the status page not to be served on a public address")
+	}
+	addr, err := mr.ServeStatus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	getStatus := func() *ClusterStatus {
+		resp, err := http.Get("http://" + addr.String() + "/status.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status ClusterStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return &status
+	}
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	blockingMap := func(filename string, contents string) []KeyValue {
+		started <- struct{}{}
+		<-release
+		return URLCountMap(filename, contents)
+	}
+	job := mr.Submit("Status", dir, blockingMap, URLCountReduce, files, 1)
+	<-started
+	<-started
+	status := getStatus()
+	if len(status.Jobs) != 1 || status.Jobs[0].State != "running" || status.Jobs[0].Map.Total != 2 || status.Workers.LocalBusy != 2 {
+		t.Fatalf("unexpected status of a running job: %+v", status)
+	}
+	close(release)
+	if _, err := job.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	failingReduce := func(key string, values []string) string { panic("bad reduce") }
+	if _, err := mr.Submit("StatusFail", dir, URLCountMap, failingReduce, files, 1).Wait(); err == nil {
+		t.Fatalf("expected the job to fail")
+	}
+	status = getStatus()
+	if len(status.Jobs) != 2 || status.Jobs[0].State != "succeeded" || status.Jobs[0].Map.Done != 2 || status.Jobs[0].Reduce.Done != 1 {
+		t.Fatalf("unexpected status of a succeeded job: %+v", status.Jobs)
+	}
+	if status.Jobs[1].State != "failed" || status.Jobs[1].Reduce.Failed != 1 {
+		t.Fatalf("unexpected status of a failed job: %+v", status.Jobs[1])
+	}
+	if len(status.RecentFailures) != 1 || status.RecentFailures[0].JobName != "StatusFail" {
+		t.Fatalf("unexpected recent failures: %+v", status.RecentFailures)
+	}
+
+	resp, err := http.Get("http://" + addr.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.Contains(string(page), "StatusFail") || !strings.Contains(string(page), "bad reduce") {
+		t.Fatalf("unexpected status page: %s, %v", page, err)
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\n", "b\n", "c\n", "d\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{NWorkers: 1})
+	defer mr.Shutdown()
+
+	var mu sync.Mutex
+	var order []string
+	started := make(chan struct{})
+	release := make(chan struct{})
+	recordingMap := func(job string) MapF {
+		return func(filename string, contents string) []KeyValue {
+			mu.Lock()
+			order = append(order, job)
+			first := len(order) == 1
+			mu.Unlock()
+			if first {
+				// hold the only worker until all jobs are submitted
+				close(started)
+				<-release
+			}
+			return URLCountMap(filename, contents)
+		}
+	}
+	big := mr.Submit("Big", dir, recordingMap("big"), URLCountReduce, files, 1)
+	<-started
+	fair := mr.Submit("Fair", dir, recordingMap("fair"), URLCountReduce, files, 1)
+	urgent := mr.Submit("Urgent", dir, recordingMap("urgent"), URLCountReduce, files[:1], 1, WithPriority(1))
+	time.Sleep(50 * time.Millisecond) // let the jobs queue their tasks
+	close(release)
+	for _, job := range []*Job{big, fair, urgent} {
+		if _, err := job.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the urgent job goes first, then the other jobs share the worker
+	if len(order) != 9 || order[1] != "urgent" {
+		t.Fatalf("expected the urgent job to go first, but the map tasks run in order %v", order)
+	}
+	turns := make(map[string]int)
+	for _, job := range order[2:6] {
+		turns[job]++
+	}
+	if turns["big"] != 2 || turns["fair"] != 2 {
+		t.Fatalf("expected the big and fair jobs to share the worker, but the map tasks run in order %v", order)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir, files := makeTestInputs(t, strings.Repeat("a\nb\n", 1000), strings.Repeat("a\nc\n", 1000))
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		compression Compression
+		level       int
+	}{
+		{NoCompression, 0},
+		{GzipCompression, flate.BestSpeed},
+		{FlateCompression, flate.BestCompression},
+	} {
+		jobName := "Compression-" + c.compression.String()
+		job := GetMRCluster().Submit(jobName, dir, URLCountMap, URLCountReduce, files, 2, WithCompression(c.compression, c.level))
+		outputs, err := job.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readOutputs(t, outputs); len(got) != len("a 2000\nb 1000\nc 1000\n") || !strings.Contains(got, "a 2000\n") {
+			t.Fatalf("%v: unexpected outputs: %q", c.compression, got)
+		}
+		metrics := job.Metrics()
+		if c.compression == NoCompression && metrics.IntermediateBytesSaved != 0 {
+			t.Fatalf("expected no bytes saved without compression, but got %d", metrics.IntermediateBytesSaved)
+		}
+		if c.compression != NoCompression && metrics.IntermediateBytesSaved < metrics.IntermediateBytes {
+			t.Fatalf("%v: expected the intermediate files to shrink by half at least, but got %d bytes saving %d", c.compression, metrics.IntermediateBytes, metrics.IntermediateBytesSaved)
+		}
+	}
+	var mapped int32
+	countingMap := func(filename string, contents string) []KeyValue {
+		atomic.AddInt32(&mapped, 1)
+		return URLCountMap(filename, contents)
+	}
+	for _, level := range []int{42, flate.HuffmanOnly - 1} {
+		job := GetMRCluster().Submit("BadLevel", dir, countingMap, URLCountReduce, files, 2, WithCompression(GzipCompression, level))
+		select {
+		case <-job.Done():
+		default:
+			t.Fatalf("expected the job with compression level %d to fail at once", level)
+		}
+		if err := job.Err(); err == nil || !strings.Contains(err.Error(), "level") {
+			t.Fatalf("expected an invalid level error, but got: %v", err)
+		}
+	}
+	if mapped != 0 {
+		t.Fatalf("expected no map task to run, but %d ran", mapped)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	var mapped, failing int32 = 0, 1
+	countingMap := func(filename string, contents string) []KeyValue {
+		atomic.AddInt32(&mapped, 1)
+		return URLCountMap(filename, contents)
+	}
+	flakyReduce := func(key string, values []string) string {
+		if key == "c" && atomic.LoadInt32(&failing) == 1 {
+			panic("flaky reduce")
+		}
+		return URLCountReduce(key, values)
+	}
+	partitioner := NewRangePartitioner("b")
+	if _, err := mr.Submit("Checkpoint", dir, countingMap, flakyReduce, files, 2, WithCheckpoint(), WithPartitioner(partitioner)).Wait(); err == nil {
+		t.Fatalf("expected the job to fail")
+	}
+	if mapped != 2 {
+		t.Fatalf("expected 2 map tasks to run, but got %d", mapped)
+	}
+
+	// the map tasks and the first reduce task are skipped
+	atomic.StoreInt32(&failing, 0)
+	job := mr.Submit("Checkpoint", dir, countingMap, flakyReduce, files, 2, WithCheckpoint(), WithPartitioner(partitioner))
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\nc 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	if mapped != 2 {
+		t.Fatalf("expected the map tasks to be skipped, but %d map tasks run", mapped)
+	}
+	metrics := job.Metrics()
+	if !metrics.Map[0].Resumed || !metrics.Map[1].Resumed || !metrics.Reduce[0].Resumed || metrics.Reduce[1].Resumed {
+		t.Fatalf("unexpected resumed tasks: %+v", metrics)
+	}
+
+	// a changed input makes the job start over
+	if err := ioutil.WriteFile(files[1], []byte("a\nd\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	outputs, err = mr.Submit("Checkpoint", dir, countingMap, flakyReduce, files, 2, WithCheckpoint(), WithPartitioner(partitioner)).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\nd 1\n" || mapped != 4 {
+		t.Fatalf("expected the job to start over, but got %q after %d map tasks", got, mapped)
+	}
+}
+
+func TestOutputCommit(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	var failing int32 = 1
+	flakyReduce := func(key string, values []string) string {
+		if key == "c" && atomic.LoadInt32(&failing) == 1 {
+			panic("flaky reduce")
+		}
+		return URLCountReduce(key, values)
+	}
+	opts := []JobOption{WithPartitioner(NewRangePartitioner("b")), WithRetry(1, 0)}
+	if _, err := mr.Submit("Commit", dir, URLCountMap, flakyReduce, files, 2, opts...).Wait(); err == nil {
+		t.Fatalf("expected the job to fail")
+	}
+	// the output of the succeeded reduce task is not published
+	if matches, _ := filepath.Glob(path.Join(dir, "mrtmp.Commit-res-*")); len(matches) != 0 {
+		t.Fatalf("outputs of the failed job are published: %v", matches)
+	}
+	if _, err := ReadSuccessManifest(dir, "Commit"); !os.IsNotExist(err) {
+		t.Fatalf("expected no _SUCCESS manifest, but got: %v", err)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	outputs, err := mr.Submit("Commit", dir, URLCountMap, flakyReduce, files, 2, opts...).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadSuccessManifest(dir, "Commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Job != "Commit" || len(m.Outputs) != len(outputs) {
+		t.Fatalf("unexpected _SUCCESS manifest: %+v", m)
+	}
+	for i, name := range outputs {
+		f, err := checksumFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != m.Outputs[i] {
+			t.Fatalf("expected %+v in the _SUCCESS manifest, but got %+v", f, m.Outputs[i])
+		}
+	}
+	if _, err := os.Stat(stagingDir(dir, "Commit")); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary directory to be removed, but got: %v", err)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+	intermediates := func() []string {
+		var names []string
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			if intermediatePattern.MatchString(info.Name()) {
+				names = append(names, info.Name())
+			}
+		}
+		return names
+	}
+
+	if _, err := mr.Submit("Cleanup", dir, URLCountMap, URLCountReduce, files, 2).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if names := intermediates(); len(names) != 0 {
+		t.Fatalf("intermediate files of the succeeded job are left: %v", names)
+	}
+
+	failingReduce := func(key string, values []string) string { panic("failing reduce") }
+	if _, err := mr.Submit("Cleanup", dir, URLCountMap, failingReduce, files, 2, WithRetention(KeepIntermediateOnFailure)).Wait(); err == nil {
+		t.Fatalf("expected the job to fail")
+	}
+	if names := intermediates(); len(names) == 0 {
+		t.Fatalf("expected the intermediate files of the failed job to be kept")
+	}
+	if err := mr.Cleanup("Cleanup"); err != nil {
+		t.Fatal(err)
+	}
+	if names := intermediates(); len(names) != 0 {
+		t.Fatalf("intermediate files are left after cleanup: %v", names)
+	}
+	// the files left by an earlier run with more tasks are found in the data dir
+	for _, name := range []string{reduceName(dir, "Cleanup", 5, 5), manifestName(dir, "Cleanup")} {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mr.Cleanup("Cleanup"); err != nil {
+		t.Fatal(err)
+	}
+	if names := intermediates(); len(names) != 0 || FileOrDirExist(manifestName(dir, "Cleanup")) {
+		t.Fatalf("files of the earlier run are left: %v", names)
+	}
+	if err := mr.Cleanup("NeverSubmitted"); err == nil {
+		t.Fatalf("expected an error cleaning up an unknown job")
+	}
+
+	release := make(chan struct{})
+	blockingMap := func(filename string, contents string) []KeyValue {
+		<-release
+		return nil
+	}
+	job := mr.Submit("Running", dir, blockingMap, URLCountReduce, files, 1)
+	if err := mr.Cleanup("Running"); err == nil {
+		t.Fatalf("expected an error cleaning up a running job")
+	}
+	close(release)
+	if _, err := job.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files left by a crashed job are swept, but not its outputs
+	os.MkdirAll(stagingDir(dir, "Crashed-1"), 0755)
+	for _, name := range []string{reduceName(dir, "Crashed-1", 0, 1), attemptName(reduceName(dir, "Crashed-1", 1, 0), 2), stagedName(dir, "Crashed-1", 0), mergeName(dir, "Crashed-1", 0)} {
+		if err := ioutil.WriteFile(name, []byte("a\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if removed, err := mr.SweepOrphans(dir, time.Hour); err != nil || len(removed) != 0 {
+		t.Fatalf("expected the recent files to be kept, but got %v, %v", removed, err)
+	}
+	removed, err := mr.SweepOrphans(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 || len(intermediates()) != 0 || !FileOrDirExist(mergeName(dir, "Crashed-1", 0)) {
+		t.Fatalf("unexpected swept files: %v", removed)
+	}
+}
+
+func TestRunRounds(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\na\n", "c\na\nb\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	rounds := ExampleURLTop10(2)
+	outputs, metrics, err := RunRounds(mr, "Rounds", dir, files, rounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a: 3\nb: 2\nc: 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	if len(metrics) != 2 || metrics[0].Name != "Rounds-Round0" || metrics[1].Name != "Rounds-Round1" {
+		t.Fatalf("unexpected metrics of the rounds: %+v", metrics)
+	}
+	if matches, _ := filepath.Glob(path.Join(dir, "mrtmp.Rounds-Round0-res-*")); len(matches) != 0 {
+		t.Fatalf("outputs of the first round are left: %v", matches)
+	}
+
+	failingReduce := func(key string, values []string) string { panic("failing reduce") }
+	rounds = append(rounds, RoundArgs{MapFunc: URLCountMap, ReduceFunc: failingReduce, NReduce: 1})
+	if _, metrics, err = RunRounds(mr, "FailingRounds", dir, files, rounds); err == nil || len(metrics) != 3 {
+		t.Fatalf("expected the third round to fail, but got %v after %d rounds", err, len(metrics))
+	}
+}
+
+func TestDAG(t *testing.T) {
+	dir, files := makeTestInputs(t, "h1/a\nh1/b\nh2/a\n", "h1/a\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	hostMap := func(filename string, contents string) []KeyValue {
+		var kvs []KeyValue
+		for _, kv := range URLCountMap(filename, contents) {
+			kvs = append(kvs, KeyValue{Key: strings.Split(kv.Key, "/")[0], Value: kv.Value})
+		}
+		return kvs
+	}
+	// the combining round tells its inputs apart by their names
+	joinMap := func(filename string, contents string) []KeyValue {
+		kind := "url:"
+		if strings.Contains(filename, "-ByHost-") {
+			kind = "host:"
+		}
+		var kvs []KeyValue
+		for _, l := range strings.Split(strings.TrimSpace(contents), "\n") {
+			fields := strings.Fields(l)
+			kvs = append(kvs, KeyValue{Key: kind + fields[0], Value: fields[1]})
+		}
+		return kvs
+	}
+	g := NewDAG().
+		Source("logs", files...).
+		Round("ByURL", RoundArgs{MapFunc: URLCountMap, ReduceFunc: URLCountReduce, NReduce: 2}, "logs").
+		Round("ByHost", RoundArgs{MapFunc: hostMap, ReduceFunc: URLCountReduce, NReduce: 2}, "logs").
+		Round("Join", RoundArgs{MapFunc: joinMap, ReduceFunc: URLCountReduce, NReduce: 1}, "ByURL", "ByHost")
+	result, err := g.Run(context.Background(), mr, "DAG", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Outputs) != 1 || len(result.Metrics) != 3 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if got := readOutputs(t, result.Outputs["Join"]); got != "host:h1 3\nhost:h2 1\nurl:h1/a 2\nurl:h1/b 1\nurl:h2/a 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	if matches, _ := filepath.Glob(path.Join(dir, "mrtmp.DAG-By*-res-*")); len(matches) != 0 {
+		t.Fatalf("outputs of the inner rounds are left: %v", matches)
+	}
+
+	failingReduce := func(key string, values []string) string { panic("failing reduce") }
+	g = NewDAG().
+		Source("logs", files...).
+		Round("Failing", RoundArgs{MapFunc: URLCountMap, ReduceFunc: failingReduce, NReduce: 1}, "logs").
+		Round("Next", RoundArgs{MapFunc: URLCountMap, ReduceFunc: URLCountReduce, NReduce: 1}, "Failing")
+	if result, err = g.Run(context.Background(), mr, "FailingDAG", dir); err == nil || len(result.Metrics) != 1 {
+		t.Fatalf("expected the failing round to stop the DAG, but got %v, %+v", err, result)
+	}
+
+	if _, err := NewDAG().Round("Orphan", RoundArgs{}, "missing").Run(context.Background(), mr, "BadDAG", dir); err == nil {
+		t.Fatalf("expected an error for an unknown node")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&sb, "url%d\n", i*7%97)
+	}
+	dir, files := makeTestInputs(t, sb.String(), sb.String())
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	expected, err := mr.Submit("Unbounded", dir, URLCountMap, URLCountReduce, files, 3).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]JobOption{
+		{WithMemoryBudget(1 << 10)},
+		{WithMemoryBudget(1 << 10), WithCombiner(URLCountCombine), WithCompression(GzipCompression, 1)},
+	} {
+		job := mr.Submit("Budget", dir, URLCountMap, URLCountReduce, files, 3, opts...)
+		outputs, err := job.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := readOutputs(t, outputs), readOutputs(t, expected); got != want {
+			t.Fatalf("expected %q, but got %q", want, got)
+		}
+		for _, m := range job.Metrics().Map {
+			if m.Spills < 2 {
+				t.Fatalf("expected map task %d to spill, but it spills %d times", m.TaskNumber, m.Spills)
+			}
+		}
+		if matches, _ := filepath.Glob(path.Join(dir, "*.spill-*")); len(matches) != 0 {
+			t.Fatalf("spilled runs are left: %v", matches)
+		}
+	}
+}
+
+func TestServeLoopbackOnly(t *testing.T) {
+	mr := NewMRCluster(Options{NWorkers: 1})
+	defer mr.Shutdown()
+
+	for _, address := range []string{":0", "0.0.0.0:0", "[::]:0"} {
+		if _, err := mr.Serve("tcp", address); err == nil {
+			t.Fatalf("expected an error serving the workers on %s", address)
+		}
+	}
+	addr, err := mr.Serve("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := addr.(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Fatalf("expected a loopback address, but got %v", addr)
+	}
+}
+
+func TestIdleWorkerLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mr_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{RemoteOnly: true, WorkerLease: 200 * time.Millisecond})
+	addr, err := mr.Serve("unix", path.Join(dir, "master.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := startWorkerProcesses(t, addr.String(), 1)
+	for i := 0; i < 500 && mr.Status().Workers.Remote == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// an idle worker keeps its lease and its pid while it polls for tasks
+	for i := 0; i < 50; i++ {
+		if n := mr.Status().Workers.Remote; n != 1 {
+			t.Fatalf("expected 1 live worker, but got %d", n)
+		}
+		mr.master.mu.Lock()
+		for id, w := range mr.master.workers {
+			if w.pid != cmds[0].Process.Pid {
+				mr.master.mu.Unlock()
+				t.Fatalf("expected worker %d to have pid %d, but got %d", id, cmds[0].Process.Pid, w.pid)
+			}
+		}
+		mr.master.mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+	mr.Shutdown()
+	for _, cmd := range cmds {
+		cmd.Wait()
+	}
+}
+
+func TestQueueSize(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\n", "b\n", "c\n", "d\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{NWorkers: 1, QueueSize: 1})
+	defer mr.Shutdown()
+
+	release := make(chan struct{})
+	blockingMap := func(filename string, contents string) []KeyValue {
+		<-release
+		return URLCountMap(filename, contents)
+	}
+	job := mr.Submit("QueueSize", dir, blockingMap, URLCountReduce, files, 1)
+	pending := func() int {
+		mr.sched.mu.Lock()
+		defer mr.sched.mu.Unlock()
+		for q := range mr.sched.active {
+			return len(q.pending)
+		}
+		return 0
+	}
+	for i := 0; i < 500 && pending() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// one map task is running, one is queued and the others wait for room
+	time.Sleep(50 * time.Millisecond)
+	if n := pending(); n != 1 {
+		t.Fatalf("expected 1 queued attempt, but got %d", n)
+	}
+	close(release)
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 1\nb 1\nc 1\nd 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+}
+
+func TestCheckpointCancel(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{NWorkers: 2})
+	defer mr.Shutdown()
+
+	var mapped [2]int32
+	release := make(chan struct{})
+	blockingMap := func(filename string, contents string) []KeyValue {
+		if filename == files[0] {
+			atomic.AddInt32(&mapped[0], 1)
+		} else {
+			atomic.AddInt32(&mapped[1], 1)
+			<-release
+		}
+		return URLCountMap(filename, contents)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := mr.SubmitContext(ctx, "CheckpointCancel", dir, blockingMap, URLCountReduce, files, 1, WithCheckpoint())
+	for i := 0; i < 500 && job.mapProgress.snapshot().Done == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if _, err := job.Wait(); err != context.Canceled {
+		t.Fatalf("expected %v, but got: %v", context.Canceled, err)
+	}
+	close(release)
+	for _, name := range []string{manifestName(dir, "CheckpointCancel"), reduceName(dir, "CheckpointCancel", 0, 0)} {
+		if !FileOrDirExist(name) {
+			t.Fatalf("expected %s to be kept for resuming", name)
+		}
+	}
+
+	outputs, err := mr.Submit("CheckpointCancel", dir, blockingMap, URLCountReduce, files, 1, WithCheckpoint()).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != "a 2\nb 1\nc 1\n" {
+		t.Fatalf("unexpected outputs: %q", got)
+	}
+	if mapped[0] != 1 {
+		t.Fatalf("expected the completed map task to be skipped, but it runs %d times", mapped[0])
+	}
+}
+
+func TestCheckpointSucceededJob(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	var mapped, reduced int32
+	countingMap := func(filename string, contents string) []KeyValue {
+		atomic.AddInt32(&mapped, 1)
+		return URLCountMap(filename, contents)
+	}
+	countingReduce := func(key string, values []string) string {
+		atomic.AddInt32(&reduced, 1)
+		return URLCountReduce(key, values)
+	}
+	opts := []JobOption{WithCheckpoint()}
+	first, err := mr.Submit("Succeeded", dir, countingMap, countingReduce, files, 2, opts...).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readOutputs(t, first)
+	if mapped != 2 || reduced != 3 {
+		t.Fatalf("expected 2 map and 3 reduce calls, but got %d and %d", mapped, reduced)
+	}
+
+	// the published outputs are resumed
+	job := mr.Submit("Succeeded", dir, countingMap, countingReduce, files, 2, opts...)
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutputs(t, outputs); got != want {
+		t.Fatalf("expected %q, but got %q", want, got)
+	}
+	if mapped != 2 || reduced != 3 {
+		t.Fatalf("expected the job to be skipped, but got %d map and %d reduce calls", mapped, reduced)
+	}
+	for _, m := range job.Metrics().Reduce {
+		if !m.Resumed {
+			t.Fatalf("expected reduce task %d to be resumed", m.TaskNumber)
+		}
+	}
+	m, err := ReadSuccessManifest(dir, "Succeeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range outputs {
+		if m.Outputs[i].Name != name {
+			t.Fatalf("expected %s in the _SUCCESS manifest, but got %+v", name, m.Outputs[i])
+		}
+	}
+}
+
+func TestReduceMemoryBudget(t *testing.T) {
+	dir, files := makeTestInputs(t, strings.Repeat("a\n", 40))
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	var maxValues int32
+	recordingReduce := func(key string, values []string) string {
+		for {
+			n := atomic.LoadInt32(&maxValues)
+			if int32(len(values)) <= n || atomic.CompareAndSwapInt32(&maxValues, n, int32(len(values))) {
+				break
+			}
+		}
+		return URLCountReduce(key, values)
+	}
+	// each of the 10 map tasks emits one combined value of the hot key
+	for _, c := range []struct {
+		budget    int64
+		maxValues int32
+	}{{0, 10}, {256, 3}} {
+		atomic.StoreInt32(&maxValues, 0)
+		outputs, err := mr.Submit("ReduceBudget", dir, URLCountMap, recordingReduce, files, 1,
+			WithCombiner(URLCountCombine), WithSplitSize(8), WithMemoryBudget(c.budget)).Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readOutputs(t, outputs); got != "a 40\n" {
+			t.Fatalf("unexpected outputs: %q", got)
+		}
+		if n := atomic.LoadInt32(&maxValues); n > c.maxValues || c.budget <= 0 && n != c.maxValues {
+			t.Fatalf("expected at most %d values of the hot key with a budget of %d, but got %d", c.maxValues, c.budget, n)
+		}
+	}
+
+	// without a combiner the values of the hot key are held in memory with a warning
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	atomic.StoreInt32(&maxValues, 0)
+	if _, err := mr.Submit("ReduceBudget", dir, URLCountMap, recordingReduce, files, 1, WithMemoryBudget(256)).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&maxValues); n != 40 {
+		t.Fatalf("expected all 40 values of the hot key, but got %d", n)
+	}
+	if !strings.Contains(logs.String(), "no combiner") {
+		t.Fatalf("expected a warning about the hot key, but got %q", logs.String())
+	}
+}
+
+func TestCancelKeepsPublishedOutputs(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n")
+	defer os.RemoveAll(dir)
+	mr := GetMRCluster()
+
+	first, err := mr.Submit("CancelRerun", dir, URLCountMap, URLCountReduce, files, 2).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readOutputs(t, first)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	hangMap := func(filename string, contents string) []KeyValue {
+		<-release
+		return nil
+	}
+	job := mr.SubmitContext(ctx, "CancelRerun", dir, hangMap, URLCountReduce, files, 2)
+	cancel()
+	if _, err := job.Wait(); err != context.Canceled {
+		t.Fatalf("expected %v, but got: %v", context.Canceled, err)
+	}
+	if got := readOutputs(t, first); got != want {
+		t.Fatalf("expected the outputs of the first run %q, but got %q", want, got)
+	}
+	if _, err := ReadSuccessManifest(dir, "CancelRerun"); err != nil {
+		t.Fatalf("expected the _SUCCESS manifest of the first run to be kept: %v", err)
+	}
+}
+
+func TestFailedMapKeepsWorkingDir(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n")
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := ioutil.WriteFile(".attempt-1", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	// the intermediate files can not be created under a regular file
+	tempDir := path.Join(dir, "notDir")
+	if err := ioutil.WriteFile(tempDir, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	mr := NewMRCluster(Options{NWorkers: 1, TempDir: tempDir})
+	defer mr.Shutdown()
+
+	if _, err := mr.Submit("BadTempDir", dir, URLCountMap, URLCountReduce, files, 3).Wait(); err == nil {
+		t.Fatalf("expected the map task to fail")
+	}
+	if !FileOrDirExist(path.Join(dir, ".attempt-1")) {
+		t.Fatalf("a file in the working directory is removed by the failed map task")
+	}
+}
+
+func TestMergeFanIn(t *testing.T) {
+	n := 2*mergeFanIn + 10
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprint(i)
+	}
+	dir, files := makeTestInputs(t, strings.Join(lines, "\n")+"\n")
+	defer os.RemoveAll(dir)
+
+	lineMap := func(filename string, contents string) []KeyValue {
+		return []KeyValue{{Key: "k", Value: strings.TrimSpace(contents)}}
+	}
+	joinReduce := func(key string, values []string) string {
+		return strings.Join(values, ",") + "\n"
+	}
+	// one map task for each line, whose outputs are merged in several passes
+	job := GetMRCluster().Submit("FanIn", dir, lineMap, joinReduce, files, 1, WithSplitSize(1), WithRetention(KeepIntermediate))
+	outputs, err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job.Metrics().Map) != n {
+		t.Fatalf("expected %d map tasks, but got %d", n, len(job.Metrics().Map))
+	}
+	if got, want := readOutputs(t, outputs), strings.Join(lines, ",")+"\n"; got != want {
+		t.Fatalf("expected the values in the order of the map tasks %q, but got %q", want, got)
+	}
+	if matches, _ := filepath.Glob(path.Join(dir, "*.merge-*")); len(matches) != 0 {
+		t.Fatalf("the merged runs are left: %v", matches)
+	}
+}
+
+func TestMixedWorkers(t *testing.T) {
+	dir, files := makeTestInputs(t, "a\nb\n", "a\nc\n", "a\n")
+	defer os.RemoveAll(dir)
+	mr := NewMRCluster(Options{NWorkers: 1})
+	addr, err := mr.Serve("unix", path.Join(dir, "master.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := startWorkerProcesses(t, addr.String(), 2)
+	registered := func() int {
+		mr.master.mu.Lock()
+		defer mr.master.mu.Unlock()
+		return len(mr.master.pids)
+	}
+	for i := 0; i < 500 && registered() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the tasks of the closure are left to the worker goroutine
+	closure := func(filename string, contents string) []KeyValue { return URLCountMap(filename, contents) }
+	for i := 0; i < 10; i++ {
+		outputs, err := mr.Submit(fmt.Sprintf("Mixed%d", i), dir, closure, URLCountReduce, files, 2).Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readOutputs(t, outputs); len(got) != len("a 3\nb 1\nc 1\n") || !strings.Contains(got, "a 3\n") {
+			t.Fatalf("unexpected outputs: %q", got)
+		}
+	}
+
+	mr.Shutdown()
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("the worker process exits with: %v", err)
+		}
+	}
+}
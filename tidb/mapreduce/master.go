@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pollTimeout is how long Master.RequestTask waits for a task before it
+	// replies that there is no task for now, it is shortened to a third of
+	// the lease so that an idle worker polls before its lease expires.
+	pollTimeout = time.Second
+	// defaultWorkerLease is the default of Options.WorkerLease.
+	defaultWorkerLease = 10 * time.Second
+)
+
+// master serves the worker processes of a MRCluster over net/rpc.
+type master struct {
+	c        *MRCluster
+	listener net.Listener
+	lease    time.Duration
+	poll     time.Duration // how long Master.RequestTask waits for a task
+
+	mu       sync.Mutex
+	workerID int                       // the last id assigned to a worker
+	workers  map[int]*workerState      // the live worker processes
+	pids     map[int]int               // the pids of the registered workers, kept after their leases expire
+	running  map[uint64]*remoteAttempt // the attempts run by worker processes
+}
+
+// workerState tracks the liveness of a worker process.
+type workerState struct {
+	pid      int // the pid of the worker process
+	expireAt time.Time
+	attempts map[uint64]struct{} // the attempts running on this worker
+}
+
+// remoteAttempt is an attempt run by a worker process.
+type remoteAttempt struct {
+	*taskAttempt
+	workerID int
+	resultCh chan error
+	metrics  TaskMetrics // reported by the worker, guarded by master.mu
+}
+
+// Serve listens on a local "tcp" or "unix" address for the worker processes
+// started by RunWorker. The worker processes pull tasks from the same queue
+// as the worker goroutines, so a crash in the user functions only takes down
+// one worker process. The tasks which can not be run by worker processes,
+// such as the ones of closures which can not be registered by RegisterFuncs,
+// are left to the worker goroutines unless Options.RemoteOnly is set, in
+// which case they fail. A "tcp" address must be a loopback address such as
+// "127.0.0.1:0", for the workers are not authenticated. It returns the
+// address being listened on.
+//
+// A worker process keeps a lease by heartbeating while it runs a task, the
+// attempts of a worker whose lease expires fail with ErrWorkerLost and are
+// re-executed by other workers.
+func (c *MRCluster) Serve(network, address string) (net.Addr, error) {
+	if strings.HasPrefix(network, "tcp") {
+		if err := checkLoopback(address); err != nil {
+			return nil, fmt.Errorf("mapreduce: the workers can only be served on a loopback address: %v", err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.master != nil {
+		return nil, errors.New("mapreduce: the cluster is already serving")
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	server := rpc.NewServer()
+	m := &master{
+		c:        c,
+		listener: l,
+		lease:    c.opts.WorkerLease,
+		workers:  make(map[int]*workerState),
+		pids:     make(map[int]int),
+		running:  make(map[uint64]*remoteAttempt),
+	}
+	if m.lease <= 0 {
+		m.lease = defaultWorkerLease
+	}
+	m.poll = pollTimeout
+	if m.poll > m.lease/3 {
+		m.poll = m.lease / 3
+	}
+	if err := server.RegisterName("Master", &masterService{m}); err != nil {
+		l.Close()
+		return nil, err
+	}
+	c.master = m
+	c.wg.Add(2)
+	go m.accept(server)
+	go m.expireWorkers()
+	return l.Addr(), nil
+}
+
+func (m *master) accept(server *rpc.Server) {
+	defer m.c.wg.Done()
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// close stops accepting new worker processes, the connected ones exit after
+// they are told that the master is shutting down.
+func (m *master) close() {
+	m.listener.Close()
+}
+
+// expireWorkers drops the workers whose leases expire, their attempts fail
+// with ErrWorkerLost.
+func (m *master) expireWorkers() {
+	defer m.c.wg.Done()
+	ticker := time.NewTicker(m.lease / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			var lost []*remoteAttempt
+			m.mu.Lock()
+			for id, w := range m.workers {
+				if now.Before(w.expireAt) {
+					continue
+				}
+				for attemptID := range w.attempts {
+					lost = append(lost, m.running[attemptID])
+				}
+				delete(m.workers, id)
+			}
+			m.mu.Unlock()
+			for _, ra := range lost {
+				ra.deliver(ErrWorkerLost)
+			}
+		case <-m.c.exit:
+			return
+		}
+	}
+}
+
+// touch renews the lease of a worker, a worker whose lease has expired
+// comes back with no attempts.
+func (m *master) touch(workerID int) {
+	m.mu.Lock()
+	m.touchLocked(workerID)
+	m.mu.Unlock()
+}
+
+func (m *master) touchLocked(workerID int) *workerState {
+	w, ok := m.workers[workerID]
+	if !ok {
+		w = &workerState{pid: m.pids[workerID], attempts: make(map[uint64]struct{})}
+		m.workers[workerID] = w
+	}
+	w.expireAt = time.Now().Add(m.lease)
+	return w
+}
+
+// takes tells whether a worker process takes an attempt. The attempts which
+// can not be run by worker processes are left to the worker goroutines,
+// unless there are none of them.
+func (m *master) takes(a *taskAttempt) bool {
+	return m.c.opts.RemoteOnly || a.cfg.remoteErrs[a.phase] == nil
+}
+
+// dispatch prepares an attempt for a worker process, the attempt fails at
+// once if it can not be run by a worker process.
+func (m *master) dispatch(a *taskAttempt, workerID int) (*TaskSpec, bool) {
+	if err := a.ctx.Err(); err != nil {
+		a.errCh <- err
+		return nil, false
+	}
+	spec, err := newTaskSpec(a)
+	if err != nil {
+		a.errCh <- err
+		return nil, false
+	}
+	ra := &remoteAttempt{taskAttempt: a, workerID: workerID, resultCh: make(chan error, 1)}
+	m.mu.Lock()
+	m.running[a.id] = ra
+	w := m.touchLocked(workerID)
+	w.attempts[a.id] = struct{}{}
+	m.mu.Unlock()
+	a.start(w.pid, workerID)
+	go func() {
+		ctx, cancel := a.context()
+		defer cancel()
+		err := a.await(ctx, ra.resultCh)
+		m.mu.Lock()
+		if err == nil {
+			a.metrics = ra.metrics
+		}
+		delete(m.running, a.id)
+		if w, ok := m.workers[ra.workerID]; ok {
+			delete(w.attempts, a.id)
+		}
+		m.mu.Unlock()
+		a.errCh <- err
+	}()
+	return spec, true
+}
+
+// deliver delivers the result of this attempt, only the first one is kept.
+func (ra *remoteAttempt) deliver(err error) bool {
+	select {
+	case ra.resultCh <- err:
+		return true
+	default:
+		return false
+	}
+}
+
+// report delivers the result of an attempt run by a worker process, the
+// results of the attempts which have been given up are dropped.
+func (m *master) report(workerID int, attemptID uint64, err error, metrics TaskMetrics) bool {
+	m.mu.Lock()
+	ra, ok := m.running[attemptID]
+	if ok && ra.workerID == workerID {
+		ra.metrics = metrics
+	}
+	m.mu.Unlock()
+	if !ok || ra.workerID != workerID {
+		return false
+	}
+	return ra.deliver(err)
+}
+
+// alive tells whether an attempt run by a worker is still waited for.
+func (m *master) alive(workerID int, attemptID uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ra, ok := m.running[attemptID]
+	if !ok || ra.workerID != workerID {
+		return false
+	}
+	w, ok := m.workers[workerID]
+	if !ok {
+		return false
+	}
+	_, ok = w.attempts[attemptID]
+	return ok
+}
+
+// claim asks to commit the outputs of an attempt run by a worker, it is
+// denied if the attempt has been given up.
+func (m *master) claim(workerID int, attemptID uint64) bool {
+	m.mu.Lock()
+	ra, ok := m.running[attemptID]
+	m.mu.Unlock()
+	if !ok || ra.workerID != workerID {
+		return false
+	}
+	return ra.claim()
+}
+
+// masterService is the RPC service used by the worker processes.
+type masterService struct {
+	m *master
+}
+
+// Register registers a worker process.
+func (s *masterService) Register(args *RegisterArgs, reply *RegisterReply) error {
+	s.m.mu.Lock()
+	s.m.workerID++
+	reply.WorkerID = s.m.workerID
+	s.m.pids[reply.WorkerID] = args.Pid
+	s.m.touchLocked(reply.WorkerID)
+	s.m.mu.Unlock()
+	reply.HeartbeatInterval = s.m.lease / 3
+	return nil
+}
+
+// RequestTask hands a task to a worker process, it waits for pollTimeout, or
+// a third of the lease if it is shorter, at most if there is no task.
+func (s *masterService) RequestTask(args *RequestTaskArgs, reply *RequestTaskReply) error {
+	s.m.touch(args.WorkerID)
+	timer := time.NewTimer(s.m.poll)
+	defer timer.Stop()
+	for {
+		a := s.m.c.sched.next(s.m.c.exit, timer.C, s.m.takes)
+		if a == nil {
+			select {
+			case <-s.m.c.exit:
+				reply.Shutdown = true
+			default:
+			}
+			return nil
+		}
+		if spec, ok := s.m.dispatch(a, args.WorkerID); ok {
+			reply.Task = spec
+			return nil
+		}
+	}
+}
+
+// Heartbeat renews the lease of a worker process running an attempt.
+func (s *masterService) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	s.m.touch(args.WorkerID)
+	reply.Abandoned = !s.m.alive(args.WorkerID, args.AttemptID)
+	return nil
+}
+
+// CommitTask asks whether an attempt may commit its outputs, only one attempt
+// of a task may.
+func (s *masterService) CommitTask(args *CommitTaskArgs, reply *CommitTaskReply) error {
+	s.m.touch(args.WorkerID)
+	reply.OK = s.m.claim(args.WorkerID, args.AttemptID)
+	return nil
+}
+
+// ReportTask reports the result of an attempt.
+func (s *masterService) ReportTask(args *ReportTaskArgs, reply *ReportTaskReply) error {
+	s.m.touch(args.WorkerID)
+	var err error
+	if args.LostMapOutput {
+		err = &mapOutputLostError{mapTask: args.MapTask, err: errors.New(args.Err)}
+	} else if args.Err != "" {
+		err = errors.New(args.Err)
+	}
+	reply.Accepted = s.m.report(args.WorkerID, args.AttemptID, err, args.Metrics)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// TaskMetrics records the successful attempt of a map or reduce task.
+type TaskMetrics struct {
+	Phase      jobPhase  `json:"phase"`
+	TaskNumber int       `json:"task"`
+	Attempts   int       `json:"attempts"`
+	Resumed    bool      `json:"resumed,omitempty"` // the task was completed by a previous submission of the job
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+
+	// InputBytes is the size of the input split of a map task, or the total
+	// size of the intermediate files read by a reduce task.
+	InputBytes int64 `json:"input_bytes"`
+	// Records is how many key/value pairs a map task emits, or how many
+	// values a reduce task reads.
+	Records int64 `json:"records"`
+	// PartitionBytes is the size of the intermediate file written by a map
+	// task for each reduce task.
+	PartitionBytes []int64 `json:"partition_bytes,omitempty"`
+	// RawIntermediateBytes is how many bytes a map task writes to its
+	// intermediate files before they are compressed.
+	RawIntermediateBytes int64 `json:"raw_intermediate_bytes,omitempty"`
+	// Spills is how many times a map task spills its buffered records to
+	// disk for exceeding the memory budget of its job.
+	Spills int `json:"spills,omitempty"`
+	// Keys is how many keys a reduce task reduces.
+	Keys int64 `json:"keys,omitempty"`
+	// OutputBytes is the size of the output file of a reduce task.
+	OutputBytes int64 `json:"output_bytes,omitempty"`
+	// Counters are the counters incremented by the user functions.
+	Counters map[string]int64 `json:"counters,omitempty"`
+	// Spans are the steps of the task, which are shown in the trace of the job.
+	Spans []Span `json:"spans,omitempty"`
+}
+
+// Duration returns how long the task ran.
+func (m *TaskMetrics) Duration() time.Duration { return m.End.Sub(m.Start) }
+
+// JobMetrics records the finished tasks of a job.
+type JobMetrics struct {
+	Name   string        `json:"name"`
+	Start  time.Time     `json:"start"`
+	End    time.Time     `json:"end"`
+	Map    []TaskMetrics `json:"map"`
+	Reduce []TaskMetrics `json:"reduce"`
+
+	Counters map[string]int64 `json:"counters"` // the sums of the counters of all tasks
+
+	// IntermediateBytes is the total size of the intermediate files, and
+	// IntermediateBytesSaved is how many bytes are saved by compressing them.
+	IntermediateBytes      int64 `json:"intermediate_bytes"`
+	IntermediateBytesSaved int64 `json:"intermediate_bytes_saved"`
+}
+
+// Duration returns how long the job ran.
+func (m *JobMetrics) Duration() time.Duration { return m.End.Sub(m.Start) }
+
+// finish records the end of a job and sums up the counters of its tasks.
+func (m *JobMetrics) finish() {
+	m.End = time.Now()
+	m.Counters = sumCounters(m.Map, m.Reduce)
+	m.IntermediateBytes, m.IntermediateBytesSaved = 0, 0
+	for _, t := range m.Map {
+		for _, size := range t.PartitionBytes {
+			m.IntermediateBytes += size
+			m.IntermediateBytesSaved -= size
+		}
+		m.IntermediateBytesSaved += t.RawIntermediateBytes
+	}
+}
+
+// collectMetrics returns the metrics of the tasks which have succeeded.
+func collectMetrics(tasks []*task) []TaskMetrics {
+	metrics := make([]TaskMetrics, 0, len(tasks))
+	for _, t := range tasks {
+		select {
+		case <-t.done:
+		default:
+			continue
+		}
+		if t.status != taskDone {
+			continue
+		}
+		m := t.metrics
+		m.Phase, m.TaskNumber, m.Attempts = t.phase, t.taskNumber, t.attempts
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// fileSize returns the size of a file, it is 0 if the file can not be stat.
+func fileSize(name string) int64 {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// writeMetricsReport writes the metrics of a job as JSON.
+func writeMetricsReport(name string, metrics *JobMetrics) error {
+	data, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(name, data)
+}
+
+// writeFileAtomically writes data to a temporary file and renames it to
+// name, so that name is never seen partially written.
+func writeFileAtomically(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// metricsName returns the name of the metrics report of a job.
+func metricsName(dataDir, jobName string) string {
+	return path.Join(dataDir, "mrtmp."+jobName+"-metrics.json")
+}
@@ -0,0 +1,23 @@
+//go:build mrworker
+// +build mrworker
+
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+// mrworker runs a worker process of a MRCluster served by MRCluster.Serve,
+// build it by `go build -tags mrworker -o mrworker`.
+func main() {
+	network := flag.String("network", "unix", "network of the master, tcp or unix")
+	address := flag.String("master", "", "address of the master")
+	flag.Parse()
+	if *address == "" {
+		log.Fatal("mrworker: -master is required")
+	}
+	if err := RunWorker(*network, *address); err != nil {
+		log.Fatal(err)
+	}
+}
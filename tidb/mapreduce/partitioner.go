@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sort"
+)
+
+// Partitioner decides which reduce task a key is sent to. Two jobs using the
+// same Partitioner and nReduce are co-partitioned, the same key goes to the
+// reduce task with the same number in both jobs.
+type Partitioner interface {
+	// Partition returns a number in [0, nReduce).
+	Partition(key string, nReduce int) int
+}
+
+// PartitionFunc is an adapter to use an ordinary function as a Partitioner.
+type PartitionFunc func(key string, nReduce int) int
+
+// Partition calls f(key, nReduce).
+func (f PartitionFunc) Partition(key string, nReduce int) int { return f(key, nReduce) }
+
+// HashPartitioner partitions keys by their FNV hash, it is the default Partitioner.
+type HashPartitioner struct{}
+
+// Partition implements the Partitioner interface.
+func (HashPartitioner) Partition(key string, nReduce int) int {
+	return ihash(key) % nReduce
+}
+
+// RangePartitioner partitions keys by sorted split points, the keys less than
+// Bounds[0] go to the reduce task 0, the keys in [Bounds[i-1], Bounds[i]) go
+// to the reduce task i and so on. The result files of the job are sorted by
+// key across reduce tasks if each reduce task writes its keys in order.
+type RangePartitioner struct {
+	Bounds []string
+}
+
+// NewRangePartitioner returns a RangePartitioner splitting keys by bounds.
+func NewRangePartitioner(bounds ...string) *RangePartitioner {
+	sorted := append([]string(nil), bounds...)
+	sort.Strings(sorted)
+	return &RangePartitioner{Bounds: sorted}
+}
+
+// Partition implements the Partitioner interface, the keys beyond the last
+// reduce task are sent to the last one.
+func (p *RangePartitioner) Partition(key string, nReduce int) int {
+	i := sort.Search(len(p.Bounds), func(i int) bool { return key < p.Bounds[i] })
+	if i >= nReduce {
+		return nReduce - 1
+	}
+	return i
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxReexecutions limits how many times a task is re-executed because its
+// worker is lost or the map outputs it reads are lost.
+const maxReexecutions = 10
+
+// mapOutputLostError is the error of a reduce task which can not find the
+// output of a map task.
+type mapOutputLostError struct {
+	mapTask int
+	err     error
+}
+
+func (e *mapOutputLostError) Error() string {
+	return fmt.Sprintf("output of map task %d is lost: %v", e.mapTask, e.err)
+}
+
+// mapRecovery re-executes the map tasks of a job whose outputs are lost in
+// the reduce phase, the reduce tasks finding the same map outputs lost at
+// the same time share one re-execution.
+type mapRecovery struct {
+	c *MRCluster
+
+	mu      sync.Mutex
+	tasks   []*task       // the latest execution of each map task
+	running map[int]*task // the re-executions in progress
+}
+
+func newMapRecovery(c *MRCluster, tasks []*task) *mapRecovery {
+	return &mapRecovery{
+		c:       c,
+		tasks:   tasks,
+		running: make(map[int]*task),
+	}
+}
+
+// latest returns the latest execution of each map task.
+func (r *mapRecovery) latest() []*task {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*task(nil), r.tasks...)
+}
+
+// rerun re-executes a map task and waits for it to finish.
+func (r *mapRecovery) rerun(mapTask int) error {
+	r.mu.Lock()
+	t, ok := r.running[mapTask]
+	if !ok {
+		old := r.tasks[mapTask]
+		t = &task{
+			dataDir:    old.dataDir,
+			jobName:    old.jobName,
+			mapFile:    old.mapFile,
+			split:      old.split,
+			phase:      old.phase,
+			taskNumber: old.taskNumber,
+			nMap:       old.nMap,
+			nReduce:    old.nReduce,
+			mapF:       old.mapF,
+			ctx:        old.ctx,
+			cfg:        old.cfg,
+			attempts:   old.attempts, // keep the attempt numbers unique
+			done:       make(chan struct{}),
+		}
+		r.running[mapTask] = t
+		go r.c.schedule(t)
+	}
+	r.mu.Unlock()
+
+	<-t.done
+	r.mu.Lock()
+	if r.running[mapTask] == t {
+		delete(r.running, mapTask)
+		r.tasks[mapTask] = t
+	}
+	r.mu.Unlock()
+	if t.status == taskFailed {
+		return &TaskError{JobName: t.jobName, Phase: t.phase, TaskNumber: t.taskNumber, Attempts: t.attempts, Err: t.err}
+	}
+	return nil
+}
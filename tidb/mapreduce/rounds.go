@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// RunRounds runs rounds on a cluster one after another, each round reads
+// the outputs of the previous one and the first round reads inputs. Round i
+// is run as the job "<jobName>-Round<i>" with opts, its outputs are removed
+// once the next round finishes. It returns the outputs of the last round
+// and the metrics of the finished rounds, the rounds after a failed one are
+// not run.
+func RunRounds(c *MRCluster, jobName, dataDir string, inputs []string, rounds RoundsArgs, opts ...JobOption) ([]string, []*JobMetrics, error) {
+	return RunRoundsContext(context.Background(), c, jobName, dataDir, inputs, rounds, opts...)
+}
+
+// RunRoundsContext is like RunRounds, but the running round is canceled if ctx is done.
+func RunRoundsContext(ctx context.Context, c *MRCluster, jobName, dataDir string, inputs []string, rounds RoundsArgs, opts ...JobOption) ([]string, []*JobMetrics, error) {
+	metrics := make([]*JobMetrics, 0, len(rounds))
+	files := inputs
+	for i, r := range rounds {
+		name := roundName(jobName, i)
+		job := c.SubmitStream(ctx, name, dataDir, r.StreamMapF(), r.ReduceFunc, files, r.NReduce, append([]JobOption{WithCombiner(r.CombineFunc)}, opts...)...)
+		outputs, err := job.Wait()
+		metrics = append(metrics, job.Metrics())
+		if i > 0 {
+			removeOutputs(dataDir, roundName(jobName, i-1), files)
+		}
+		if err != nil {
+			return nil, metrics, fmt.Errorf("round %d of %s: %v", i, jobName, err)
+		}
+		files = outputs
+	}
+	return files, metrics, nil
+}
+
+func roundName(jobName string, round int) string {
+	return fmt.Sprintf("%s-Round%d", jobName, round)
+}
+
+// removeOutputs removes the outputs of a succeeded job and its _SUCCESS manifest.
+func removeOutputs(dataDir, jobName string, outputs []string) {
+	os.Remove(successName(dataDir, jobName))
+	for _, name := range outputs {
+		os.Remove(name)
+	}
+}
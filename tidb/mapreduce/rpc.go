@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The functions of a job are sent to the worker processes by their names,
+// a worker process must register the same functions as the master by
+// calling RegisterFuncs in init().
+var funcRegistry = struct {
+	sync.RWMutex
+	m map[string]interface{}
+}{m: make(map[string]interface{})}
+
+// RegisterFuncs registers MapF, StreamMapF, ContextMapF, ReduceF,
+// ContextReduceF and CombineF functions
+// so that the tasks using them can be run by worker processes. Closures
+// can not be registered since they have no stable names.
+func RegisterFuncs(fs ...interface{}) {
+	funcRegistry.Lock()
+	defer funcRegistry.Unlock()
+	for _, f := range fs {
+		switch f := f.(type) {
+		case MapF:
+			funcRegistry.m[funcName(f)] = (func(string, string) []KeyValue)(f)
+		case func(string, string) []KeyValue:
+			funcRegistry.m[funcName(f)] = f
+		case StreamMapF:
+			funcRegistry.m[funcName(f)] = (func(string, io.Reader, Emitter) error)(f)
+		case func(string, io.Reader, Emitter) error:
+			funcRegistry.m[funcName(f)] = f
+		case ContextMapF:
+			funcRegistry.m[funcName(f)] = (func(context.Context, string, io.Reader, Emitter) error)(f)
+		case func(context.Context, string, io.Reader, Emitter) error:
+			funcRegistry.m[funcName(f)] = f
+		case ReduceF:
+			funcRegistry.m[funcName(f)] = (func(string, []string) string)(f)
+		case CombineF:
+			funcRegistry.m[funcName(f)] = (func(string, []string) string)(f)
+		case func(string, []string) string:
+			funcRegistry.m[funcName(f)] = f
+		case ContextReduceF:
+			funcRegistry.m[funcName(f)] = (func(context.Context, string, []string) string)(f)
+		case func(context.Context, string, []string) string:
+			funcRegistry.m[funcName(f)] = f
+		default:
+			panic(fmt.Sprintf("can not register %T", f))
+		}
+	}
+}
+
+func lookupFunc(name string) (interface{}, error) {
+	funcRegistry.RLock()
+	defer funcRegistry.RUnlock()
+	f, ok := funcRegistry.m[name]
+	if !ok {
+		return nil, fmt.Errorf("function %q is not registered", name)
+	}
+	return f, nil
+}
+
+func lookupMapF(name string) (ContextMapF, error) {
+	f, err := lookupFunc(name)
+	if err != nil {
+		return nil, err
+	}
+	switch f := f.(type) {
+	case func(string, string) []KeyValue:
+		return MapF(f).Stream().withContext(), nil
+	case func(string, io.Reader, Emitter) error:
+		return StreamMapF(f).withContext(), nil
+	case func(context.Context, string, io.Reader, Emitter) error:
+		return f, nil
+	}
+	return nil, fmt.Errorf("function %q is not a map function", name)
+}
+
+func lookupReduceF(name string) (func(string, []string) string, error) {
+	f, err := lookupFunc(name)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := f.(func(string, []string) string); ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("function %q is not a reduce or combine function", name)
+}
+
+func lookupContextReduceF(name string) (ContextReduceF, error) {
+	f, err := lookupFunc(name)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := f.(func(context.Context, string, []string) string); ok {
+		return f, nil
+	}
+	reduceF, err := lookupReduceF(name)
+	if err != nil {
+		return nil, err
+	}
+	return ReduceF(reduceF).withContext(), nil
+}
+
+// funcName returns the name of a function, it is "" for nil.
+func funcName(f interface{}) string {
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return ""
+	}
+	return runtime.FuncForPC(v.Pointer()).Name()
+}
+
+// TaskSpec describes an attempt of a task sent to a worker process.
+type TaskSpec struct {
+	AttemptID        uint64
+	Attempt          int
+	JobName          string
+	DataDir          string
+	TempDir          string
+	Phase            jobPhase
+	TaskNumber       int
+	NMap             int
+	NReduce          int
+	MapFile          string
+	Offset           int64
+	Length           int64
+	MapF             string
+	ReduceF          string
+	CombineF         string
+	Format           IntermediateFormat
+	Compression      Compression
+	CompressionLevel int
+	MemoryBudget     int64
+	Timeout          time.Duration
+
+	// Partitioner is "hash" or "range", RangeBounds are the bounds of a RangePartitioner.
+	Partitioner string
+	RangeBounds []string
+}
+
+// newTaskSpec describes an attempt for a worker process, it returns an error
+// if the attempt can not be run by a worker process.
+func newTaskSpec(a *taskAttempt) (*TaskSpec, error) {
+	spec := &TaskSpec{
+		AttemptID:        a.id,
+		Attempt:          a.number,
+		JobName:          a.jobName,
+		DataDir:          a.dataDir,
+		TempDir:          a.cfg.tempDir,
+		Phase:            a.phase,
+		TaskNumber:       a.taskNumber,
+		NMap:             a.nMap,
+		NReduce:          a.nReduce,
+		MapFile:          a.split.file,
+		Offset:           a.split.offset,
+		Length:           a.split.length,
+		MapF:             a.cfg.mapFName,
+		ReduceF:          a.cfg.reduceFName,
+		CombineF:         funcName(a.cfg.combineF),
+		Format:           a.cfg.format,
+		Compression:      a.cfg.compression,
+		CompressionLevel: a.cfg.compressionLevel,
+		MemoryBudget:     a.cfg.memoryBudget,
+		Timeout:          a.cfg.taskTimeout,
+	}
+	if err := a.cfg.remoteErrs[a.phase]; err != nil {
+		return nil, err
+	}
+	switch p := a.cfg.partitioner.(type) {
+	case HashPartitioner:
+		spec.Partitioner = "hash"
+	case *RangePartitioner:
+		spec.Partitioner, spec.RangeBounds = "range", p.Bounds
+	}
+	return spec, nil
+}
+
+// remoteError returns why the tasks of phase of a job can not be run by
+// worker processes, it is nil if they can.
+func (cfg *jobConfig) remoteError(phase jobPhase) error {
+	switch p := cfg.partitioner.(type) {
+	case HashPartitioner, *RangePartitioner:
+	default:
+		return fmt.Errorf("partitioner %T can not be used by worker processes", p)
+	}
+	// make sure the worker processes can find the functions
+	var err error
+	if phase == mapPhase {
+		_, err = lookupMapF(cfg.mapFName)
+	} else {
+		_, err = lookupContextReduceF(cfg.reduceFName)
+	}
+	if name := funcName(cfg.combineF); err == nil && name != "" {
+		_, err = lookupReduceF(name)
+	}
+	return err
+}
+
+// newTask rebuilds the task described by this spec in a worker process.
+func (spec *TaskSpec) newTask() (*task, error) {
+	cfg := &jobConfig{
+		maxAttempts:      1,
+		format:           spec.Format,
+		compression:      spec.Compression,
+		compressionLevel: spec.CompressionLevel,
+		memoryBudget:     spec.MemoryBudget,
+		tempDir:          spec.TempDir,
+		taskTimeout:      spec.Timeout,
+	}
+	switch spec.Partitioner {
+	case "hash":
+		cfg.partitioner = HashPartitioner{}
+	case "range":
+		cfg.partitioner = &RangePartitioner{Bounds: spec.RangeBounds}
+	default:
+		return nil, fmt.Errorf("unknown partitioner %q", spec.Partitioner)
+	}
+	t := &task{
+		dataDir:    spec.DataDir,
+		jobName:    spec.JobName,
+		mapFile:    spec.MapFile,
+		split:      inputSplit{file: spec.MapFile, offset: spec.Offset, length: spec.Length},
+		phase:      spec.Phase,
+		taskNumber: spec.TaskNumber,
+		nMap:       spec.NMap,
+		nReduce:    spec.NReduce,
+		cfg:        cfg,
+	}
+	var err error
+	if spec.CombineF != "" {
+		// reduce任务在超出内存预算时也用combiner合并同一个key的值
+		if cfg.combineF, err = lookupReduceF(spec.CombineF); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Phase == mapPhase {
+		if t.mapF, err = lookupMapF(spec.MapF); err != nil {
+			return nil, err
+		}
+	} else {
+		if t.reduceF, err = lookupContextReduceF(spec.ReduceF); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// RegisterArgs is the argument of Master.Register.
+type RegisterArgs struct {
+	Pid int
+}
+
+// RegisterReply is the reply of Master.Register.
+type RegisterReply struct {
+	WorkerID          int
+	HeartbeatInterval time.Duration // how often to heartbeat while running a task
+}
+
+// RequestTaskArgs is the argument of Master.RequestTask.
+type RequestTaskArgs struct {
+	WorkerID int
+}
+
+// RequestTaskReply is the reply of Master.RequestTask, Task is nil if there
+// is no task to run for now.
+type RequestTaskReply struct {
+	Task     *TaskSpec
+	Shutdown bool // the master is shutting down, the worker should exit
+}
+
+// HeartbeatArgs is the argument of Master.Heartbeat.
+type HeartbeatArgs struct {
+	WorkerID  int
+	AttemptID uint64 // the attempt being run
+}
+
+// HeartbeatReply is the reply of Master.Heartbeat.
+type HeartbeatReply struct {
+	Abandoned bool // the attempt has been given up by the master
+}
+
+// CommitTaskArgs is the argument of Master.CommitTask.
+type CommitTaskArgs struct {
+	WorkerID  int
+	AttemptID uint64
+}
+
+// CommitTaskReply is the reply of Master.CommitTask.
+type CommitTaskReply struct {
+	OK bool // false if another attempt of the task has committed or the attempt has been given up
+}
+
+// ReportTaskArgs is the argument of Master.ReportTask.
+type ReportTaskArgs struct {
+	WorkerID  int
+	AttemptID uint64
+	Err       string // empty if the attempt succeeded
+
+	// LostMapOutput is true if a reduce task can not find the output of map task MapTask.
+	LostMapOutput bool
+	MapTask       int
+
+	Metrics TaskMetrics // the metrics of a successful attempt
+}
+
+// ReportTaskReply is the reply of Master.ReportTask.
+type ReportTaskReply struct {
+	Accepted bool // false if the attempt has been given up by the master
+}
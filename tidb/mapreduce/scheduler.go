@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// jobQueue holds the attempts of a job waiting for workers.
+type jobQueue struct {
+	seq      uint64 // the order the job is submitted in
+	priority int
+	weight   float64
+	pending  []*taskAttempt
+	running  int     // how many attempts of the job are handed to workers
+	served   float64 // how many attempts have been handed to workers for the weight
+}
+
+// share is how much of the workers the job is using for its weight.
+func (q *jobQueue) share() float64 {
+	return float64(q.running) / q.weight
+}
+
+// scheduler hands the queued attempts to workers. The job with the highest
+// priority goes first, the jobs with the same priority share the workers by
+// their weights: a free worker takes an attempt of the job using the least
+// workers for its weight, then the one served the least for its weight, and
+// then the earliest submitted one.
+type scheduler struct {
+	limit int // how many attempts can wait in the queue of a job, 0 is unlimited
+
+	mu     sync.Mutex
+	seq    uint64
+	active map[*jobQueue]struct{} // the queues with pending or running attempts
+	wake   chan struct{}          // closed when an attempt is queued
+	freed  chan struct{}          // closed when an attempt leaves a queue
+}
+
+func newScheduler(limit int) *scheduler {
+	return &scheduler{
+		limit:  limit,
+		active: make(map[*jobQueue]struct{}),
+		wake:   make(chan struct{}),
+		freed:  make(chan struct{}),
+	}
+}
+
+// newQueue creates the queue of a job.
+func (s *scheduler) newQueue(priority int, weight float64) *jobQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return &jobQueue{seq: s.seq, priority: priority, weight: weight}
+}
+
+// push queues an attempt, it waits for the queue of the job to have room
+// if the queue is full. It returns false if the attempt is given up before
+// it is queued.
+func (s *scheduler) push(a *taskAttempt) bool {
+	s.mu.Lock()
+	q := a.cfg.queue
+	for s.limit > 0 && len(q.pending) >= s.limit {
+		freed := s.freed
+		s.mu.Unlock()
+		select {
+		case <-freed:
+		case <-a.ctx.Done():
+			return false
+		}
+		s.mu.Lock()
+	}
+	q.pending = append(q.pending, a)
+	if _, ok := s.active[q]; !ok {
+		// 新加入的作业从正在运行的作业中服务最少的位置开始，不能因为之前没有运行而一直优先
+		min := -1.0
+		for o := range s.active {
+			if o.priority == q.priority && (min < 0 || o.served < min) {
+				min = o.served
+			}
+		}
+		if min > q.served {
+			q.served = min
+		}
+		s.active[q] = struct{}{}
+	}
+	close(s.wake)
+	s.wake = make(chan struct{})
+	s.mu.Unlock()
+	return true
+}
+
+// remove removes a queued attempt, it returns false if the attempt has been
+// handed to a worker.
+func (s *scheduler) remove(a *taskAttempt) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := a.cfg.queue
+	for i, p := range q.pending {
+		if p == a {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			s.deactivate(q)
+			s.signalFreed()
+			return true
+		}
+	}
+	return false
+}
+
+// done records that an attempt handed to a worker is finished.
+func (s *scheduler) done(a *taskAttempt) {
+	s.mu.Lock()
+	q := a.cfg.queue
+	q.running--
+	s.deactivate(q)
+	s.mu.Unlock()
+}
+
+// signalFreed wakes up the attempts waiting for room in their queues.
+func (s *scheduler) signalFreed() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+func (s *scheduler) deactivate(q *jobQueue) {
+	if q.running == 0 && len(q.pending) == 0 {
+		delete(s.active, q)
+	}
+}
+
+// next waits for an attempt to run, it returns nil if exit is closed or
+// timeout fires first. timeout may be nil to wait forever. Only the attempts
+// accepted by accept are taken, all attempts are taken if it is nil.
+func (s *scheduler) next(exit <-chan struct{}, timeout <-chan time.Time, accept func(*taskAttempt) bool) *taskAttempt {
+	for {
+		s.mu.Lock()
+		var best *jobQueue
+		index := 0 // the attempt taken from best
+		for q := range s.active {
+			if i := q.first(accept); i >= 0 && (best == nil || q.before(best)) {
+				best, index = q, i
+			}
+		}
+		if best != nil {
+			a := best.pending[index]
+			best.pending = append(best.pending[:index], best.pending[index+1:]...)
+			best.running++
+			best.served += 1 / best.weight
+			s.signalFreed()
+			s.mu.Unlock()
+			return a
+		}
+		wake := s.wake
+		s.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-exit:
+			return nil
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// first returns the index of the first pending attempt of q accepted by
+// accept, it returns -1 if there is none.
+func (q *jobQueue) first(accept func(*taskAttempt) bool) int {
+	for i, a := range q.pending {
+		if accept == nil || accept(a) {
+			return i
+		}
+	}
+	return -1
+}
+
+// before tells whether a free worker should take an attempt of q before o.
+func (q *jobQueue) before(o *jobQueue) bool {
+	if q.priority != o.priority {
+		return q.priority > o.priority
+	}
+	if mine, theirs := q.share(), o.share(); mine != theirs {
+		return mine < theirs
+	}
+	if q.served != o.served {
+		return q.served < o.served
+	}
+	return q.seq < o.seq
+}
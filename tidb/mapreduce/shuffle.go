@@ -0,0 +1,301 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// sortKVs sorts key/value pairs by key, the values of the same key keep their order.
+func sortKVs(kvs []KeyValue) {
+	sort.SliceStable(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+}
+
+// readIntermediate calls fn for each record in an intermediate file.
+func readIntermediate(fileName string, format IntermediateFormat, compression Compression, fn func(kv KeyValue)) error {
+	r, err := openIntermediate(fileName, format, compression, readBufferSize)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		kv, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %v", fileName, err)
+		}
+		fn(kv)
+	}
+}
+
+// mergeSource is a sorted intermediate file being merged.
+type mergeSource struct {
+	index int // the number of the map task writing this file
+	kv    KeyValue
+	r     kvReader
+}
+
+// mergeHeap is a min heap of mergeSources ordered by their current keys,
+// the sources of the same key are ordered by their map task numbers.
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key == h[j].kv.Key {
+		return h[i].index < h[j].index
+	}
+	return h[i].kv.Key < h[j].kv.Key
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// mergeFanIn is how many files a mergeReader reads at once at most.
+const mergeFanIn = 64
+
+// mergeReader k-way merges the sorted intermediate files of a task, only the
+// current record of each file and the values of one key are kept in memory.
+type mergeReader struct {
+	files []*intermediateReader
+	h     mergeHeap
+	size  int64    // the total size of the merged files
+	runs  []string // the runs merged by this reader, removed by Close
+
+	fold   CombineF // combines the values of a key exceeding budget, nil if they are not combined
+	budget int64
+	warned bool // whether a key exceeding budget without fold has been logged
+}
+
+// openMergeReader opens a mergeReader of fileNames, which are the outputs of
+// the map tasks in their order or the runs spilled by a map task. At most
+// mergeFanIn files are read at once: if there are more, they are merged
+// mergeFanIn at a time into sorted runs named by runName first, until few
+// enough are left. The read buffers of the files take about half of the
+// memory budget of the job.
+func openMergeReader(fileNames []string, cfg *jobConfig, runName func(run int) string) (*mergeReader, error) {
+	var size int64
+	for _, fileName := range fileNames {
+		size += fileSize(fileName)
+	}
+	var runs []string
+	first := 0 // the number of the map task writing fileNames[0], -1 for the runs
+	for len(fileNames) > mergeFanIn {
+		merged := make([]string, 0, (len(fileNames)+mergeFanIn-1)/mergeFanIn)
+		for i := 0; i < len(fileNames); i += mergeFanIn {
+			end := i + mergeFanIn
+			if end > len(fileNames) {
+				end = len(fileNames)
+			}
+			offset := -1
+			if first >= 0 {
+				offset = first + i
+			}
+			name := runName(len(runs))
+			runs = append(runs, name)
+			if err := mergeRun(fileNames[i:end], offset, name, cfg); err != nil {
+				removeFiles(runs)
+				return nil, err
+			}
+			merged = append(merged, name)
+		}
+		fileNames, first = merged, -1
+	}
+	m, err := openMergeFiles(fileNames, first, cfg)
+	if err != nil {
+		removeFiles(runs)
+		return nil, err
+	}
+	m.size, m.runs = size, runs
+	return m, nil
+}
+
+// mergeRun merges fileNames into a sorted run named name.
+func mergeRun(fileNames []string, first int, name string, cfg *jobConfig) (err error) {
+	m, err := openMergeFiles(fileNames, first, cfg)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	w, err := createIntermediate(name, cfg.format, cfg.compression, cfg.compressionLevel)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for {
+		kv, err := m.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.Write(kv); err != nil {
+			return err
+		}
+	}
+}
+
+// openMergeFiles opens at most mergeFanIn files and merges them at once.
+// A file not found is reported as a lost map output if first, the number of
+// the map task writing fileNames[0], is not negative.
+func openMergeFiles(fileNames []string, first int, cfg *jobConfig) (*mergeReader, error) {
+	m := &mergeReader{
+		files: make([]*intermediateReader, 0, len(fileNames)),
+		h:     make(mergeHeap, 0, len(fileNames)),
+	}
+	bufSize := mergeBufferSize(cfg.memoryBudget, len(fileNames), cfg.compression)
+	for i, fileName := range fileNames {
+		r, err := openIntermediate(fileName, cfg.format, cfg.compression, bufSize)
+		if err != nil {
+			m.Close()
+			if os.IsNotExist(err) && first >= 0 {
+				return nil, &mapOutputLostError{mapTask: first + i, err: err}
+			}
+			return nil, err
+		}
+		m.files = append(m.files, r)
+		s := &mergeSource{index: i, r: r}
+		if err := m.advance(s); err == io.EOF {
+			continue
+		} else if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("read %s: %v", fileName, err)
+		}
+		m.h = append(m.h, s)
+	}
+	heap.Init(&m.h)
+	return m, nil
+}
+
+// mergeBufferSize returns the size of each read buffer of n files merged at
+// once, so that the buffers take about half of budget. A compressed file is
+// read through two buffers.
+func mergeBufferSize(budget int64, n int, compression Compression) int {
+	if budget <= 0 || n <= 0 {
+		return readBufferSize
+	}
+	buffers := int64(n)
+	if compression != NoCompression {
+		buffers *= 2
+	}
+	size := budget / 2 / buffers
+	if size > readBufferSize {
+		return readBufferSize
+	}
+	if size < minReadBufferSize {
+		return minReadBufferSize
+	}
+	return int(size)
+}
+
+func (m *mergeReader) advance(s *mergeSource) error {
+	kv, err := s.r.Read()
+	if err != nil {
+		return err
+	}
+	s.kv = kv
+	return nil
+}
+
+// next returns the next record in the order of keys, it returns io.EOF if
+// all files are consumed.
+func (m *mergeReader) next() (KeyValue, error) {
+	if len(m.h) == 0 {
+		return KeyValue{}, io.EOF
+	}
+	s := m.h[0]
+	kv := s.kv
+	if err := m.advance(s); err == io.EOF {
+		heap.Pop(&m.h)
+		return kv, nil
+	} else if err != nil {
+		return KeyValue{}, fmt.Errorf("read %s: %v", m.files[s.index].f.Name(), err)
+	}
+	if s.kv.Key < kv.Key {
+		return KeyValue{}, fmt.Errorf("%s is not sorted by key", m.files[s.index].f.Name())
+	}
+	heap.Fix(&m.h, 0)
+	return kv, nil
+}
+
+// bound combines the values of a key by fold whenever they take more than
+// budget bytes, so that a key with many values does not take all memory.
+// If fold is nil the values are held in memory, and a warning is logged
+// the first time they exceed budget. It does nothing if budget is not positive.
+func (m *mergeReader) bound(fold CombineF, budget int64) {
+	if budget > 0 {
+		m.fold, m.budget = fold, budget
+	}
+}
+
+// NextGroup returns the next key and all its values, it returns io.EOF if
+// all files are consumed. The values may have been partly combined if the
+// reader is bounded.
+func (m *mergeReader) NextGroup() (string, []string, error) {
+	if len(m.h) == 0 {
+		return "", nil, io.EOF
+	}
+	key := m.h[0].kv.Key
+	var values []string
+	var size int64
+	for len(m.h) > 0 && m.h[0].kv.Key == key {
+		kv, err := m.next()
+		if err != nil {
+			return "", nil, err
+		}
+		values = append(values, kv.Value)
+		if size += int64(len(kv.Value)) + kvOverhead; m.budget <= 0 || size <= m.budget {
+			continue
+		}
+		if m.fold == nil {
+			// 没有combiner时无法合并，只能全部放在内存中，记录一次警告
+			if !m.warned {
+				m.warned = true
+				log.Printf("mapreduce: the values of key %q exceed the memory budget of %d bytes, they are held in memory since the job has no combiner", key, m.budget)
+			}
+		} else if len(values) > 1 {
+			// 同一个key的值超出预算时先用combiner合并
+			values = []string{m.fold(key, values)}
+			size = int64(len(values[0])) + kvOverhead
+		}
+	}
+	return key, values, nil
+}
+
+// Size returns the total size of the merged files.
+func (m *mergeReader) Size() int64 { return m.size }
+
+// Close closes all files and removes the runs merged by this reader.
+func (m *mergeReader) Close() error {
+	var err error
+	for _, r := range m.files {
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+	}
+	removeFiles(m.runs)
+	return err
+}
+
+// removeFiles removes the files of names.
+func removeFiles(names []string) {
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// speculationInterval is how often a running task is checked for being a straggler.
+const speculationInterval = 50 * time.Millisecond
+
+// errCommitDenied is the error of an attempt which finishes after another
+// attempt of the same task has committed its outputs.
+var errCommitDenied = errors.New("another attempt of the task has committed")
+
+// phaseStats records the run times of the finished tasks in a phase of a job.
+type phaseStats struct {
+	mu        sync.Mutex
+	durations []time.Duration
+}
+
+func (s *phaseStats) record(d time.Duration) {
+	s.mu.Lock()
+	s.durations = append(s.durations, d)
+	s.mu.Unlock()
+}
+
+// median returns the median run time of the finished tasks, ok is false if
+// no task is finished yet.
+func (s *phaseStats) median() (d time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.durations) == 0 {
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), s.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2], true
+}
+
+// start records that the worker tid of process pid starts running this attempt.
+func (a *taskAttempt) start(pid, tid int) {
+	a.pid, a.tid = pid, tid
+	atomic.StoreInt64(&a.startedAt, time.Now().UnixNano())
+}
+
+// elapsed returns how long this attempt has been running, ok is false if it
+// is still waiting for a worker.
+func (a *taskAttempt) elapsed() (d time.Duration, ok bool) {
+	startedAt := atomic.LoadInt64(&a.startedAt)
+	if startedAt == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, startedAt)), true
+}
+
+// straggling tells whether this attempt runs much longer than the median run
+// time of the finished tasks in its phase.
+func (a *taskAttempt) straggling() bool {
+	elapsed, ok := a.elapsed()
+	if !ok || a.stats == nil {
+		return false
+	}
+	median, ok := a.stats.median()
+	if !ok {
+		return false
+	}
+	limit := time.Duration(float64(median) * a.cfg.speculation)
+	if limit < a.cfg.speculationMin {
+		limit = a.cfg.speculationMin
+	}
+	return elapsed > limit
+}
+
+// claim asks to commit the outputs of this attempt, only one attempt of a
+// task is allowed to until it fails.
+func (a *taskAttempt) claim() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.committer != 0 && a.committer != a.id {
+		return false
+	}
+	a.committer = a.id
+	return true
+}
+
+// unclaim allows the other attempts of a task to commit after this one fails.
+func (a *taskAttempt) unclaim() {
+	a.mu.Lock()
+	if a.committer == a.id {
+		a.committer = 0
+	}
+	a.mu.Unlock()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	// defaultMemoryBudget is the default of WithMemoryBudget.
+	defaultMemoryBudget = 64 << 20
+	// kvOverhead is the estimated memory used by a buffered record besides its key and value.
+	kvOverhead = 64
+)
+
+// mapBuffer buffers the records emitted by a map task by their partitions.
+// If the buffered records exceed the memory budget of the job, they are
+// spilled to disk as a sorted run for each partition, and the runs are
+// merged into the intermediate files after the map function returns.
+type mapBuffer struct {
+	t          *task
+	attempt    int
+	partitions [][]KeyValue
+	indexes    map[string]int // the partitions of the buffered keys, to call Partition() less
+	size       int64          // the estimated memory used by the buffered records
+	spills     int            // how many times the records are spilled
+	runs       [][]string     // the spilled runs of each partition
+}
+
+func newMapBuffer(t *task, attempt int) *mapBuffer {
+	return &mapBuffer{
+		t:          t,
+		attempt:    attempt,
+		partitions: make([][]KeyValue, t.nReduce),
+		indexes:    make(map[string]int),
+		runs:       make([][]string, t.nReduce),
+	}
+}
+
+// add buffers a record, the buffered records are spilled if they exceed the budget.
+func (b *mapBuffer) add(kv KeyValue) error {
+	r, ok := b.indexes[kv.Key]
+	if !ok {
+		r = b.t.cfg.partitioner.Partition(kv.Key, b.t.nReduce)
+		if r < 0 || r >= b.t.nReduce {
+			return fmt.Errorf("partition %d of key %q is out of range [0, %d)", r, kv.Key, b.t.nReduce)
+		}
+		b.indexes[kv.Key] = r
+		b.size += int64(len(kv.Key))
+	}
+	b.partitions[r] = append(b.partitions[r], kv)
+	b.size += int64(len(kv.Key)+len(kv.Value)) + kvOverhead
+	if budget := b.t.cfg.memoryBudget; budget > 0 && b.size > budget {
+		return b.spill()
+	}
+	return nil
+}
+
+// sorted combines the records of a partition if the job has a combiner and sorts them by key.
+func (b *mapBuffer) sorted(kvs []KeyValue) []KeyValue {
+	if b.t.cfg.combineF != nil {
+		kvs = combine(kvs, b.t.cfg.combineF)
+	}
+	sortKVs(kvs)
+	return kvs
+}
+
+// spill writes the buffered records of each partition to a sorted run.
+func (b *mapBuffer) spill() error {
+	cfg := b.t.cfg
+	for r, kvs := range b.partitions {
+		if len(kvs) == 0 {
+			continue
+		}
+		name := spillName(reduceName(cfg.tempDir, b.t.jobName, b.t.taskNumber, r), b.attempt, b.spills)
+		b.runs[r] = append(b.runs[r], name)
+		w, err := createIntermediate(name, cfg.format, cfg.compression, cfg.compressionLevel)
+		if err != nil {
+			return err
+		}
+		for _, kv := range b.sorted(kvs) {
+			if err := w.Write(kv); err != nil {
+				w.Close()
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		b.partitions[r] = nil
+	}
+	b.indexes = make(map[string]int)
+	b.size = 0
+	b.spills++
+	return nil
+}
+
+// flush spills the remaining records if any records have been spilled, so
+// that all records of a partition are in its runs.
+func (b *mapBuffer) flush() error {
+	if b.spills == 0 || b.size == 0 {
+		return nil
+	}
+	return b.spill()
+}
+
+// write writes the records of partition r sorted by key to w, the spilled
+// runs of the partition are merged and combined again if the job has a combiner.
+func (b *mapBuffer) write(r int, w *intermediateWriter) error {
+	if b.spills == 0 {
+		for _, kv := range b.sorted(b.partitions[r]) {
+			if err := w.Write(kv); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	runName := func(run int) string {
+		return spillName(reduceName(b.t.cfg.tempDir, b.t.jobName, b.t.taskNumber, r), b.attempt, b.spills+run)
+	}
+	mr, err := openMergeReader(b.runs[r], b.t.cfg, runName)
+	if err != nil {
+		return err
+	}
+	defer mr.Close()
+	mr.bound(b.t.cfg.combineF, b.t.cfg.memoryBudget)
+	for {
+		key, values, err := mr.NextGroup()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b.t.cfg.combineF != nil {
+			values = []string{b.t.cfg.combineF(key, values)}
+		}
+		for _, value := range values {
+			if err := w.Write(KeyValue{Key: key, Value: value}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// remove removes the spilled runs.
+func (b *mapBuffer) remove() {
+	for _, runs := range b.runs {
+		for _, name := range runs {
+			os.Remove(name)
+		}
+	}
+}
+
+// spillName returns the name of a sorted run spilled by an attempt of a map task.
+func spillName(name string, attempt, run int) string {
+	return attemptName(name, attempt) + ".spill-" + strconv.Itoa(run)
+}
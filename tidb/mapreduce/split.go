@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// inputSplit is a byte range of an input file read by one map task,
+// length < 0 means the split lasts to the end of the file.
+type inputSplit struct {
+	file   string
+	offset int64
+	length int64
+}
+
+// planSplits cuts the input files into splits of about splitSize bytes, each
+// split ends right after a '\n' so that no line is cut into two splits.
+// Every file is one split if splitSize is not positive.
+func planSplits(files []string, splitSize int64) ([]inputSplit, error) {
+	splits := make([]inputSplit, 0, len(files))
+	for _, file := range files {
+		if splitSize <= 0 {
+			splits = append(splits, inputSplit{file: file, length: -1})
+			continue
+		}
+		fileSplits, err := planFileSplits(file, splitSize)
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, fileSplits...)
+	}
+	return splits, nil
+}
+
+func planFileSplits(file string, splitSize int64) ([]inputSplit, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	var splits []inputSplit
+	for offset := int64(0); offset < size; {
+		end := offset + splitSize
+		if end >= size {
+			end = size
+		} else if end, err = nextLineStart(f, end, size); err != nil {
+			return nil, err
+		}
+		splits = append(splits, inputSplit{file: file, offset: offset, length: end - offset})
+		offset = end
+	}
+	if len(splits) == 0 {
+		// an empty file is still a map task
+		splits = append(splits, inputSplit{file: file})
+	}
+	return splits, nil
+}
+
+// nextLineStart returns the offset of the first line starting at or after off.
+func nextLineStart(f *os.File, off, size int64) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, off-1, size-off+1))
+	for {
+		b, err := r.ReadSlice('\n')
+		off += int64(len(b))
+		if err == nil {
+			return off - 1, nil
+		}
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return 0, err
+		}
+	}
+}
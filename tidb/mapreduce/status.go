@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxFinishedJobs is how many finished jobs are kept for the status page.
+	maxFinishedJobs = 100
+	// maxRecentFailures is how many failed attempts are kept for the status page.
+	maxRecentFailures = 20
+)
+
+// ClusterStatus is a snapshot of a MRCluster shown by its status page.
+type ClusterStatus struct {
+	Time           time.Time        `json:"time"`
+	Workers        WorkerStatus     `json:"workers"`
+	Jobs           []JobStatus      `json:"jobs"` // the running and recently finished jobs
+	RecentFailures []AttemptFailure `json:"recent_failures"`
+}
+
+// WorkerStatus tells how many workers are busy running attempts.
+type WorkerStatus struct {
+	Local      int `json:"local"`
+	LocalBusy  int `json:"local_busy"`
+	Remote     int `json:"remote"` // the live worker processes
+	RemoteBusy int `json:"remote_busy"`
+}
+
+// Utilization returns the fraction of the workers which are busy.
+func (s WorkerStatus) Utilization() float64 {
+	if s.Local+s.Remote == 0 {
+		return 0
+	}
+	return float64(s.LocalBusy+s.RemoteBusy) / float64(s.Local+s.Remote)
+}
+
+// JobStatus is the status of a job.
+type JobStatus struct {
+	Name   string        `json:"name"`
+	State  string        `json:"state"` // "running", "succeeded" or "failed"
+	Start  time.Time     `json:"start"`
+	End    time.Time     `json:"end"`
+	Map    PhaseProgress `json:"map"`
+	Reduce PhaseProgress `json:"reduce"`
+	Err    string        `json:"error,omitempty"`
+}
+
+// PhaseProgress tells how many tasks of a phase are finished.
+type PhaseProgress struct {
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+	Total  int `json:"total"`
+}
+
+// AttemptFailure records a failed attempt.
+type AttemptFailure struct {
+	Time       time.Time `json:"time"`
+	JobName    string    `json:"job"`
+	Phase      jobPhase  `json:"phase"`
+	TaskNumber int       `json:"task"`
+	Attempt    int       `json:"attempt"`
+	Err        string    `json:"error"`
+}
+
+// phaseProgress counts the finished tasks of a phase.
+type phaseProgress struct {
+	done, failed, total int32
+}
+
+func (p *phaseProgress) start(total int) { atomic.StoreInt32(&p.total, int32(total)) }
+
+func (p *phaseProgress) finish(err error) {
+	if err != nil {
+		atomic.AddInt32(&p.failed, 1)
+	} else {
+		atomic.AddInt32(&p.done, 1)
+	}
+}
+
+func (p *phaseProgress) snapshot() PhaseProgress {
+	return PhaseProgress{
+		Done:   int(atomic.LoadInt32(&p.done)),
+		Failed: int(atomic.LoadInt32(&p.failed)),
+		Total:  int(atomic.LoadInt32(&p.total)),
+	}
+}
+
+// track adds a job to the jobs shown by the status page, the oldest finished
+// jobs are dropped if there are too many.
+func (c *MRCluster) track(job *Job) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	finished := 0
+	for _, j := range c.jobs {
+		if j.finished() {
+			finished++
+		}
+	}
+	jobs := c.jobs[:0]
+	for _, j := range c.jobs {
+		if finished > maxFinishedJobs-1 && j.finished() {
+			finished--
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	c.jobs = append(jobs, job)
+}
+
+// recordFailure records a failed attempt, the attempts given up by the
+// scheduler are not failures.
+func (c *MRCluster) recordFailure(a *taskAttempt, err error) {
+	if a.ctx.Err() != nil {
+		return
+	}
+	f := AttemptFailure{
+		Time:       time.Now(),
+		JobName:    a.jobName,
+		Phase:      a.phase,
+		TaskNumber: a.taskNumber,
+		Attempt:    a.number,
+		Err:        err.Error(),
+	}
+	c.mu.Lock()
+	c.failures = append(c.failures, f)
+	if len(c.failures) > maxRecentFailures {
+		c.failures = c.failures[len(c.failures)-maxRecentFailures:]
+	}
+	c.mu.Unlock()
+}
+
+// Status returns a snapshot of this cluster.
+func (c *MRCluster) Status() *ClusterStatus {
+	s := &ClusterStatus{Time: time.Now()}
+	if !c.opts.RemoteOnly {
+		s.Workers.Local = c.nWorkers
+		s.Workers.LocalBusy = int(atomic.LoadInt32(&c.busy))
+	}
+	c.mu.Lock()
+	jobs := append([]*Job(nil), c.jobs...)
+	s.RecentFailures = append([]AttemptFailure(nil), c.failures...)
+	m := c.master
+	c.mu.Unlock()
+	if m != nil {
+		m.mu.Lock()
+		s.Workers.Remote, s.Workers.RemoteBusy = len(m.workers), len(m.running)
+		m.mu.Unlock()
+	}
+	for _, j := range jobs {
+		s.Jobs = append(s.Jobs, j.status())
+	}
+	return s
+}
+
+// ServeStatus serves a status page of this cluster over HTTP on a loopback
+// address such as "127.0.0.1:0", the page lists the running and recently
+// finished jobs with the progress of their phases, the utilization of the
+// workers and the recent failed attempts. The same status is served as JSON
+// at /status.json. It returns the address being listened on.
+func (c *MRCluster) ServeStatus(address string) (net.Addr, error) {
+	if err := checkLoopback(address); err != nil {
+		return nil, fmt.Errorf("mapreduce: the status page can only be served on a loopback address: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.statusServer != nil {
+		return nil, errors.New("mapreduce: the cluster is already serving its status")
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", c.serveStatusPage)
+	mux.HandleFunc("/status.json", c.serveStatusJSON)
+	c.statusServer = &http.Server{Handler: mux}
+	c.wg.Add(1)
+	go func(server *http.Server) {
+		defer c.wg.Done()
+		server.Serve(l)
+	}(c.statusServer)
+	return l.Addr(), nil
+}
+
+// checkLoopback returns an error if address is not a loopback address.
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s is not a loopback address", address)
+	}
+	return nil
+}
+
+// closeStatus stops serving the status page.
+func (c *MRCluster) closeStatus() {
+	c.mu.Lock()
+	server := c.statusServer
+	c.mu.Unlock()
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if server.Shutdown(ctx) != nil {
+			server.Close()
+		}
+	}
+}
+
+func (c *MRCluster) serveStatusJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(c.Status())
+}
+
+func (c *MRCluster) serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, c.Status())
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"elapsed": func(j JobStatus) time.Duration {
+		end := j.End
+		if end.IsZero() {
+			end = time.Now()
+		}
+		return end.Sub(j.Start).Round(time.Millisecond)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="refresh" content="2">
+<title>MapReduce cluster</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>MapReduce cluster</h1>
+<p>{{.Time.Format "2006-01-02 15:04:05"}}, <a href="/status.json">JSON</a></p>
+
+<h2>Workers</h2>
+<table>
+<tr><th></th><th>Busy</th><th>Total</th></tr>
+<tr><td>Local</td><td>{{.Workers.LocalBusy}}</td><td>{{.Workers.Local}}</td></tr>
+<tr><td>Remote</td><td>{{.Workers.RemoteBusy}}</td><td>{{.Workers.Remote}}</td></tr>
+</table>
+<p>Utilization: {{percent .Workers.Utilization}}</p>
+
+<h2>Jobs</h2>
+<table>
+<tr><th>Name</th><th>State</th><th>Elapsed</th><th>Map</th><th>Reduce</th><th>Error</th></tr>
+{{range .Jobs}}<tr>
+<td>{{.Name}}</td><td>{{.State}}</td><td>{{elapsed .}}</td>
+<td>{{.Map.Done}}/{{.Map.Total}}{{if .Map.Failed}} ({{.Map.Failed}} failed){{end}}</td>
+<td>{{.Reduce.Done}}/{{.Reduce.Total}}{{if .Reduce.Failed}} ({{.Reduce.Failed}} failed){{end}}</td>
+<td>{{.Err}}</td>
+</tr>
+{{end}}</table>
+
+<h2>Recent failures</h2>
+<table>
+<tr><th>Time</th><th>Job</th><th>Phase</th><th>Task</th><th>Attempt</th><th>Error</th></tr>
+{{range .RecentFailures}}<tr>
+<td>{{.Time.Format "15:04:05.000"}}</td><td>{{.JobName}}</td><td>{{.Phase}}</td><td>{{.TaskNumber}}</td><td>{{.Attempt}}</td><td>{{.Err}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
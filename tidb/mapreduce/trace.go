@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span is a step of a task attempt shown in the trace of a job.
+type Span struct {
+	Name  string           `json:"name"`
+	Start time.Time        `json:"start"`
+	End   time.Time        `json:"end"`
+	Args  map[string]int64 `json:"args,omitempty"`
+}
+
+// traceEvent is an event of the Chrome trace_event format, which can be
+// loaded by chrome://tracing or https://ui.perfetto.dev.
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   int64                  `json:"ts"` // in microseconds
+	Dur  int64                  `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// jobTracePid is the pid of the events of the phases of a job, the events
+// of the attempts are shown under the pids of the processes running them.
+const jobTracePid = 0
+
+// jobTrace records the timeline of a job, each worker is a thread of the
+// process running it and each attempt is a span on the thread of its worker.
+type jobTrace struct {
+	fileName string
+
+	mu      sync.Mutex
+	events  []traceEvent
+	workers map[[2]int]bool // the (pid, tid) of the workers seen
+}
+
+func newJobTrace(fileName string) *jobTrace {
+	return &jobTrace{fileName: fileName, workers: make(map[[2]int]bool)}
+}
+
+func (tr *jobTrace) add(e traceEvent) {
+	tr.mu.Lock()
+	tr.events = append(tr.events, e)
+	tr.mu.Unlock()
+}
+
+func (tr *jobTrace) span(name, cat string, start, end time.Time, pid, tid int, args map[string]interface{}) {
+	tr.add(traceEvent{
+		Name: name,
+		Cat:  cat,
+		Ph:   "X",
+		Ts:   start.UnixNano() / int64(time.Microsecond),
+		Dur:  int64(end.Sub(start) / time.Microsecond),
+		Pid:  pid,
+		Tid:  tid,
+		Args: args,
+	})
+}
+
+// tracePhase records a phase of a traced job which ends now.
+func (cfg *jobConfig) tracePhase(phase jobPhase, start time.Time) {
+	if cfg.trace != nil {
+		cfg.trace.span(string(phase), "phase", start, time.Now(), jobTracePid, 0, nil)
+	}
+}
+
+// attempt records an attempt which has been run by a worker, the spans of a
+// successful attempt are recorded as its sub-spans.
+func (tr *jobTrace) attempt(a *taskAttempt, end time.Time, err error) {
+	elapsed, ok := a.elapsed()
+	if !ok {
+		// the attempt is given up before a worker runs it
+		return
+	}
+	args := map[string]interface{}{"task": a.taskNumber, "attempt": a.number}
+	if err != nil {
+		args["error"] = err.Error()
+	}
+	name := string(a.phase)
+	tr.span(name, "attempt", end.Add(-elapsed), end, a.pid, a.tid, args)
+	for _, s := range a.metrics.Spans {
+		var spanArgs map[string]interface{}
+		if len(s.Args) > 0 {
+			spanArgs = make(map[string]interface{}, len(s.Args))
+			for k, v := range s.Args {
+				spanArgs[k] = v
+			}
+		}
+		tr.span(s.Name, name, s.Start, s.End, a.pid, a.tid, spanArgs)
+	}
+	tr.mu.Lock()
+	tr.workers[[2]int{a.pid, a.tid}] = true
+	tr.mu.Unlock()
+}
+
+// write writes the trace as a JSON object.
+func (tr *jobTrace) write(jobName string) error {
+	tr.mu.Lock()
+	events := append([]traceEvent(nil), tr.events...)
+	workers := make([][2]int, 0, len(tr.workers))
+	for w := range tr.workers {
+		workers = append(workers, w)
+	}
+	tr.mu.Unlock()
+
+	sort.Slice(workers, func(i, j int) bool {
+		if workers[i][0] != workers[j][0] {
+			return workers[i][0] < workers[j][0]
+		}
+		return workers[i][1] < workers[j][1]
+	})
+	meta := []traceEvent{{Name: "process_name", Ph: "M", Pid: jobTracePid, Args: map[string]interface{}{"name": "job " + jobName}}}
+	for _, w := range workers {
+		meta = append(meta, traceEvent{Name: "thread_name", Ph: "M", Pid: w[0], Tid: w[1], Args: map[string]interface{}{"name": "worker " + strconv.Itoa(w[1])}})
+	}
+	data, err := json.Marshal(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{append(meta, events...), "ms"})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(tr.fileName, data)
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
 
+func init() {
+	RegisterFuncs(URLCountMap, URLCountStreamMap, URLCountCombine, URLCountReduce, URLTop10Map, URLTop10Reduce)
+}
+
 // URLTop10 generates RoundsArgs for getting the 10 most frequent URLs.
 // There are two rounds in this approach.
 // The first round will do url count.
@@ -16,9 +22,11 @@ func URLTop10(nWorkers int) RoundsArgs {
 	var args RoundsArgs
 	// round 1: do url count
 	args = append(args, RoundArgs{
-		MapFunc:    URLCountMap,
-		ReduceFunc: URLCountReduce,
-		NReduce:    nWorkers,
+		MapFunc:       URLCountMap,
+		StreamMapFunc: URLCountStreamMap,
+		ReduceFunc:    URLCountReduce,
+		CombineFunc:   URLCountCombine,
+		NReduce:       nWorkers,
 	})
 	// round 2: sort and get the 10 most frequent URLs
 	args = append(args, RoundArgs{
@@ -38,14 +46,48 @@ func URLCountMap(filename string, contents string) []KeyValue {
 		if len(l) == 0 {
 			continue
 		}
-		kvs = append(kvs, KeyValue{Key: l})
+		kvs = append(kvs, KeyValue{Key: l, Value: "1"})
 	}
 	return kvs
 }
 
+// URLCountStreamMap is the streaming version of URLCountMap
+func URLCountStreamMap(filename string, r io.Reader, emit Emitter) error {
+	br := bufio.NewReaderSize(r, 64*KB)
+	for {
+		l, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if l = strings.TrimSpace(l); len(l) > 0 {
+			if err := emit(KeyValue{Key: l, Value: "1"}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// URLCountCombine is the combine function in the first round
+func URLCountCombine(key string, values []string) string {
+	return strconv.Itoa(sumCounts(values))
+}
+
 // URLCountReduce is the reduce function in the first round
 func URLCountReduce(key string, values []string) string {
-	return key + " " + strconv.Itoa(len(values)) + "\n"
+	return key + " " + strconv.Itoa(sumCounts(values)) + "\n"
+}
+
+func sumCounts(values []string) int {
+	sum := 0
+	for _, v := range values {
+		n, err := strconv.Atoi(v)
+		PanicErr(err)
+		sum += n
+	}
+	return sum
 }
 
 // URLTop10Map is the map function in the second round
@@ -7,6 +7,10 @@ import (
 	"strings"
 )
 
+func init() {
+	RegisterFuncs(ExampleURLCountMap, ExampleURLCountReduce, ExampleURLTop10Map, ExampleURLTop10Reduce)
+}
+
 // ExampleURLTop10 generates RoundsArgs for getting the 10 most frequent URLs.
 // There are two rounds in this approach.
 // The first round will do url count.
@@ -83,11 +83,9 @@ func testURLTop(t *testing.T, rounds RoundsArgs) {
 
 			// run map-reduce rounds
 			begin := time.Now()
-			inputFiles := c.MapFiles
-			for idx, r := range rounds {
-				jobName := fmt.Sprintf("Case%d-Round%d", i, idx)
-				ch := mr.Submit(jobName, prefix, r.MapFunc, r.ReduceFunc, inputFiles, r.NReduce)
-				inputFiles = <-ch
+			inputFiles, _, err := RunRounds(mr, fmt.Sprintf("Case%d", i), prefix, c.MapFiles, rounds)
+			if err != nil {
+				t.Fatalf("Case%d FAIL, dataSize=%v, nMapFiles=%v\n%v\n", i, dataSize[k], nMapFiles[k], err)
 			}
 			cost := time.Since(begin)
 
@@ -18,9 +18,19 @@ const (
 
 // RoundArgs contains arguments used in a map-reduce round.
 type RoundArgs struct {
-	MapFunc    MapF
-	ReduceFunc ReduceF
-	NReduce    int
+	MapFunc       MapF
+	StreamMapFunc StreamMapF // optional, used instead of MapFunc if it is set
+	ReduceFunc    ReduceF
+	CombineFunc   CombineF // optional
+	NReduce       int
+}
+
+// StreamMapF returns the map function of this round as a StreamMapF.
+func (r RoundArgs) StreamMapF() StreamMapF {
+	if r.StreamMapFunc != nil {
+		return r.StreamMapFunc
+	}
+	return r.MapFunc.Stream()
 }
 
 // RoundsArgs represents arguments used in multiple map-reduce rounds.
@@ -181,22 +191,40 @@ func CheckFile(expected, got string) (string, bool) {
 
 // CreateFileAndBuf opens or creates a specific file for writing.
 func CreateFileAndBuf(fpath string) (*os.File, *bufio.Writer) {
+	f, buf, err := createFileAndBuf(fpath)
+	if err != nil {
+		panic(err)
+	}
+	return f, buf
+}
+
+// createFileAndBuf is the same as CreateFileAndBuf but returns the error instead of panicking.
+func createFileAndBuf(fpath string) (*os.File, *bufio.Writer, error) {
 	dir := path.Dir(fpath)
 	os.MkdirAll(dir, 0777)
 	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	return f, bufio.NewWriterSize(f, 1<<20)
+	return f, bufio.NewWriterSize(f, 1<<20), nil
 }
 
 // OpenFileAndBuf opens a specific file for reading.
 func OpenFileAndBuf(fpath string) (*os.File, *bufio.Reader) {
-	f, err := os.OpenFile(fpath, os.O_RDONLY, 0666)
+	f, buf, err := openFileAndBuf(fpath)
 	if err != nil {
 		panic(err)
 	}
-	return f, bufio.NewReader(f)
+	return f, buf
+}
+
+// openFileAndBuf is the same as OpenFileAndBuf but returns the error instead of panicking.
+func openFileAndBuf(fpath string) (*os.File, *bufio.Reader, error) {
+	f, err := os.OpenFile(fpath, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, bufio.NewReader(f), nil
 }
 
 // WriteToBuf write strs to this buffer.
@@ -210,14 +238,22 @@ func WriteToBuf(buf *bufio.Writer, strs ...string) {
 
 // SafeClose flushes this buffer and closes this file.
 func SafeClose(f *os.File, buf *bufio.Writer) {
+	if err := closeFileAndBuf(f, buf); err != nil {
+		panic(err)
+	}
+}
+
+// closeFileAndBuf is the same as SafeClose but returns the error instead of panicking,
+// the file is always closed even if flushing the buffer failed.
+func closeFileAndBuf(f *os.File, buf *bufio.Writer) error {
+	var err error
 	if buf != nil {
-		if err := buf.Flush(); err != nil {
-			panic(err)
-		}
+		err = buf.Flush()
 	}
-	if err := f.Close(); err != nil {
-		panic(err)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
+	return err
 }
 
 // FileOrDirExist tests if this file or dir exist in a simple way.
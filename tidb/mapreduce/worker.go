@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"os"
+	"time"
+)
+
+// testHookBeforeTask is called by RunWorker before it runs a task,
+// it is used by tests to inject stalls and crashes of worker processes.
+var testHookBeforeTask func(spec *TaskSpec)
+
+// RunWorker runs a worker process connected to the master listening on the
+// address served by MRCluster.Serve, it runs the tasks one by one until the
+// master shuts down or goes away. The functions used by the tasks must be
+// registered by RegisterFuncs in this process.
+func RunWorker(network, address string) error {
+	client, err := rpc.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var reg RegisterReply
+	if err := client.Call("Master.Register", &RegisterArgs{Pid: os.Getpid()}, &reg); err != nil {
+		return err
+	}
+	for {
+		var reply RequestTaskReply
+		if err := client.Call("Master.RequestTask", &RequestTaskArgs{WorkerID: reg.WorkerID}, &reply); err != nil {
+			return masterGone(err)
+		}
+		if reply.Shutdown {
+			return nil
+		}
+		if reply.Task == nil {
+			continue
+		}
+		if testHookBeforeTask != nil {
+			testHookBeforeTask(reply.Task)
+		}
+		args, err := runTaskSpec(client, reg, reply.Task)
+		if err != nil {
+			return masterGone(err)
+		}
+		if err := client.Call("Master.ReportTask", args, &ReportTaskReply{}); err != nil {
+			return masterGone(err)
+		}
+	}
+}
+
+// runTaskSpec runs a task described by spec in this process and heartbeats
+// while it is running. The outputs of the task are not committed if the
+// master gives it up. It returns the report of the task.
+func runTaskSpec(client *rpc.Client, reg RegisterReply, spec *TaskSpec) (*ReportTaskArgs, error) {
+	report := &ReportTaskArgs{WorkerID: reg.WorkerID, AttemptID: spec.AttemptID}
+	t, err := spec.newTask()
+	if err != nil {
+		report.Err = err.Error()
+		return report, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if spec.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), spec.Timeout)
+	}
+	defer cancel()
+
+	claim := func() bool {
+		var reply CommitTaskReply
+		args := &CommitTaskArgs{WorkerID: reg.WorkerID, AttemptID: spec.AttemptID}
+		return client.Call("Master.CommitTask", args, &reply) == nil && reply.OK
+	}
+	var m TaskMetrics
+	errCh := make(chan error, 1)
+	go func() { errCh <- doTask(ctx, t, spec.Attempt, claim, &m) }()
+	ticker := time.NewTicker(reg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errCh:
+			if lost, ok := err.(*mapOutputLostError); ok {
+				report.LostMapOutput, report.MapTask = true, lost.mapTask
+			}
+			if err != nil {
+				report.Err = err.Error()
+			} else {
+				report.Metrics = m
+			}
+			return report, nil
+		case <-ticker.C:
+			var reply HeartbeatReply
+			args := &HeartbeatArgs{WorkerID: reg.WorkerID, AttemptID: spec.AttemptID}
+			if err := client.Call("Master.Heartbeat", args, &reply); err != nil {
+				return nil, err
+			}
+			if reply.Abandoned {
+				cancel()
+			}
+		}
+	}
+}
+
+// masterGone returns nil if err means the connection to the master is closed.
+func masterGone(err error) error {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}